@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"balanced/pkg/configuration"
+	"balanced/pkg/loadbalancer"
+	"fmt"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var rollback = &cobra.Command{
+	Use:   "rollback <domain> [revision]",
+	Short: "Restore a previous revision of a domain's configuration and reload",
+	Long: `Restores a revision kept in config-dir/.history, the latest one unless a revision is given,
+validates it with validate-cmd if set and runs reload-cmd. The restored configuration is kept until
+the next change to the domain's service is rendered.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		cfgPath, _ := cmd.Flags().GetString("config")
+		cfg, err := configuration.New(cfgPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if cfg.LoadBalancer.Type != configuration.BackendTypeFile {
+			log.Fatalf("rollback is only supported by the %s load balancer type", configuration.BackendTypeFile)
+		}
+
+		revision := 0
+		if len(args) == 2 {
+			revision, err = strconv.Atoi(args[1])
+			if err != nil || revision <= 0 {
+				log.Fatalf("invalid revision %q", args[1])
+			}
+		}
+
+		b, err := loadbalancer.NewFileBackend(cfg.LoadBalancer)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		restored, err := b.Rollback(args[0], revision)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("restored revision %d of %s\n", restored, args[0])
+	},
+}
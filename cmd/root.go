@@ -4,10 +4,10 @@ import (
 	"balanced/pkg/configuration"
 	"balanced/pkg/k8s"
 	"balanced/pkg/loadbalancer"
+	"balanced/pkg/queue"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -23,45 +23,88 @@ var root = &cobra.Command{
 			log.Fatal(err)
 		}
 
-		lb, lbErr := loadbalancer.NewUpdater(cfg)
-		if lbErr != nil {
-			log.Fatal(lbErr)
-		}
-
 		w, err := k8s.NewWatcher(cfg.Kubernetes)
 		if err != nil {
 			log.Fatal(err)
 		}
 
+		stop := make(chan struct{})
+
+		opts := []loadbalancer.UpdaterOptions{loadbalancer.WithEventRecorder(w.EventRecorder())}
+
+		var released <-chan struct{}
+
+		// only the instance holding the lease manages DNS, every instance keeps rendering configuration
+		if le := cfg.Kubernetes.LeaderElection; le != nil && le.Enabled {
+			var leading <-chan bool
+			leading, released, err = w.RunLeaderElection(le, stop)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			opts = append(opts, loadbalancer.WithLeaderElection(leading))
+		}
+
+		lb, lbErr := loadbalancer.NewUpdater(cfg, opts...)
+		if lbErr != nil {
+			log.Fatal(lbErr)
+		}
+
 		sig := make(chan os.Signal, 1)
 
 		signal.Notify(sig, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
 
-		stop := make(chan struct{})
-		defer close(stop)
+		changes := queue.New(*cfg.LoadBalancer.RetryAttempts)
 
 		// Start watching for Endpoint Changes
-		changes := w.Start(stop)
+		w.Start(stop, changes)
+
+		// with the caches synced, configuration of domains deleted while not running can be removed
+		domains, err := w.Domains()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := lb.RemoveStale(domains); err != nil {
+			log.Errorf("unable to remove stale configuration: %s", err)
+		}
 
 		// Start update process listening to changes which come in
-		go lb.Start(changes)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			lb.Start(changes, stop)
+		}()
 
 		select {
 		case <-cmd.Context().Done():
 		case <-sig:
-			close(changes)
-			stop <- struct{}{}
-			log.Println("stopping")
-			if err := lb.OnExit(); err != nil {
-				log.Errorln(err.Error())
-			}
-			time.Sleep(time.Second)
+		}
+
+		log.Println("stopping")
+		close(stop)
+		changes.ShutDown()
+
+		// records must not be removed until the updater has stopped, or it could add them again
+		<-done
+
+		// the lease is released on stopping, so that a standby can take over without waiting for it to expire
+		if released != nil {
+			<-released
+		}
+
+		if err := lb.OnExit(); err != nil {
+			log.Errorln(err.Error())
 		}
 	},
 }
 
 func Execute() {
-	root.Flags().StringP("config", "c", "./balanced.toml", "Path to config file")
+	root.PersistentFlags().StringP("config", "c", "./balanced.toml", "Path to config file")
+	root.AddCommand(rollback)
+
+	templateCmd.AddCommand(templateTest)
+	root.AddCommand(templateCmd)
 
 	if err := root.Execute(); err != nil {
 		log.Fatal(err)
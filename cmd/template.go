@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"balanced/pkg/configuration"
+	"balanced/pkg/loadbalancer"
+	"balanced/pkg/types"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// fixtures rendered by "template test" when no fixture file is given
+var defaultFixtures = []*types.LoadBalancerUpstreamDefinition{
+	{
+		Domain:      "api.example.com",
+		HealthCheck: "/healthz",
+		Namespace:   "default",
+		Service:     "api",
+		Labels:      map[string]string{"app": "api"},
+		Annotations: map[string]string{"domains": "api.example.com", "health-check": "/healthz", "balance": "leastconn"},
+		Servers: []*types.Server{
+			{Id: "api-7d9f8b6c5-abcde", IPAddress: "10.0.1.10", Port: 8080, Meta: &types.ServerMeta{NodeName: "node-a", Zone: "eu-west-1a"}},
+			{Id: "api-7d9f8b6c5-fghij", IPAddress: "10.0.2.11", Port: 8080, Meta: &types.ServerMeta{NodeName: "node-b", Zone: "eu-west-1b"}},
+		},
+	},
+	{
+		Domain:    "www.example.com",
+		Namespace: "default",
+		Service:   "web",
+		Servers: []*types.Server{
+			{Id: "web-5c6d7e8f9-klmno", IPAddress: "10.0.1.20", Port: 80, Meta: &types.ServerMeta{NodeName: "node-a", Zone: "eu-west-1a"}},
+		},
+	},
+}
+
+var templateCmd = &cobra.Command{
+	Use:   "template",
+	Short: "Work with the load balancer template",
+}
+
+var templateTest = &cobra.Command{
+	Use:   "test [fixtures.json]",
+	Short: "Render the configured template against fixture definitions",
+	Long: `Renders the template configured in [loadbalancer], using template, template-file and template-dir,
+against a JSON list of upstream definitions, or a built-in example when no file is given, and prints
+the result. Each definition is rendered separately unless aggregate is enabled.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cfgPath, _ := cmd.Flags().GetString("config")
+		cfg, err := configuration.New(cfgPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fixtures := defaultFixtures
+		if len(args) == 1 {
+			data, err := os.ReadFile(args[0])
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			if err := json.Unmarshal(data, &fixtures); err != nil {
+				log.Fatalf("unable to parse fixtures %s: %s", args[0], err)
+			}
+		}
+		sort.Slice(fixtures, func(i, j int) bool { return fixtures[i].Domain < fixtures[j].Domain })
+
+		templateText, err := cfg.LoadBalancer.TemplateText()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		r, err := loadbalancer.NewRenderer(templateText, cfg.LoadBalancer.TemplateDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if agg := cfg.LoadBalancer.Aggregate; agg != nil && agg.Enabled {
+			if err := r.ToWriterAll(os.Stdout, &loadbalancer.Upstreams{Upstreams: fixtures, MapFile: agg.MapFile}); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+
+		for _, def := range fixtures {
+			fmt.Printf("# %s\n", def.Domain)
+			if err := r.ToWriter(os.Stdout, def); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println()
+		}
+	},
+}
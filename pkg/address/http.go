@@ -0,0 +1,51 @@
+package address
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// httpSource asks a "what is my ip" style service which responds with the caller's address as plain text.
+type httpSource struct {
+	client *http.Client
+	url    string
+}
+
+func (h *httpSource) Address(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to query %s: %s", h.url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %d", h.url, resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return "", fmt.Errorf("unable to read response from %s: %s", h.url, err)
+	}
+
+	return parseIP(strings.TrimSpace(string(data)))
+}
+
+func newHTTPSource(url string) (*httpSource, error) {
+	if url == "" {
+		return nil, errors.New("dns.address-discovery.url not set in config")
+	}
+
+	return &httpSource{client: &http.Client{}, url: url}, nil
+}
@@ -0,0 +1,51 @@
+package address
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPSource_Address(t *testing.T) {
+	tests := map[string]struct {
+		handler         http.HandlerFunc
+		expectedAddress string
+		expectedErr     string
+	}{
+		"returns address from response body": {
+			func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "203.0.113.7\n") },
+			"203.0.113.7",
+			"",
+		},
+		"returns error when body is not an ip address": {
+			func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "<html>hello</html>") },
+			"",
+			"\"<html>hello</html>\" is not a valid ip address",
+		},
+		"returns error on unexpected status": {
+			func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusServiceUnavailable) },
+			"",
+			"returned 503",
+		},
+	}
+
+	for name, test := range tests {
+		srv := httptest.NewServer(test.handler)
+
+		src, _ := newHTTPSource(srv.URL)
+		addr, err := src.Address(context.Background())
+
+		if test.expectedErr != "" {
+			assert.ErrorContains(t, err, test.expectedErr, name)
+		} else {
+			assert.NoError(t, err, name)
+		}
+		assert.Equal(t, test.expectedAddress, addr, name)
+
+		srv.Close()
+	}
+}
@@ -0,0 +1,61 @@
+package address
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// interfaceSource uses the first usable address of the given family assigned to a network interface.
+type interfaceSource struct {
+	name string
+	ipv6 bool
+}
+
+func (i *interfaceSource) Address(context.Context) (string, error) {
+	iface, err := net.InterfaceByName(i.name)
+	if err != nil {
+		return "", fmt.Errorf("unable to find interface %s: %s", i.name, err)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("unable to list addresses for interface %s: %s", i.name, err)
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		if isIPv4 := ipNet.IP.To4() != nil; isIPv4 == i.ipv6 {
+			continue
+		}
+
+		return ipNet.IP.String(), nil
+	}
+
+	family := "ipv4"
+	if i.ipv6 {
+		family = "ipv6"
+	}
+
+	return "", fmt.Errorf("interface %s has no %s address", i.name, family)
+}
+
+func newInterfaceSource(name, family string) (*interfaceSource, error) {
+	if name == "" {
+		return nil, errors.New("dns.address-discovery.interface not set in config")
+	}
+
+	switch family {
+	case "ipv4":
+		return &interfaceSource{name: name}, nil
+	case "ipv6":
+		return &interfaceSource{name: name, ipv6: true}, nil
+	}
+
+	return nil, fmt.Errorf("dns.address-discovery.ip-family %q is not supported, expected one of: ipv4, ipv6", family)
+}
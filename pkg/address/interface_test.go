@@ -0,0 +1,47 @@
+package address
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterfaceSource_Address(t *testing.T) {
+	tests := map[string]struct {
+		name            string
+		expectedAddress string
+		expectedErr     string
+	}{
+		"returns ipv4 address of loopback": {
+			"lo",
+			"127.0.0.1",
+			"",
+		},
+		"returns error for unknown interface": {
+			"does-not-exist0",
+			"",
+			"unable to find interface does-not-exist0",
+		},
+	}
+
+	for name, test := range tests {
+		src, _ := newInterfaceSource(test.name, "ipv4")
+		addr, err := src.Address(context.Background())
+
+		if test.expectedErr != "" {
+			assert.ErrorContains(t, err, test.expectedErr, name)
+		} else {
+			assert.NoError(t, err, name)
+		}
+		assert.Equal(t, test.expectedAddress, addr, name)
+	}
+}
+
+func TestNewInterfaceSource(t *testing.T) {
+	_, err := newInterfaceSource("", "ipv4")
+	assert.EqualError(t, err, "dns.address-discovery.interface not set in config")
+
+	_, err = newInterfaceSource("eth0", "ipx")
+	assert.EqualError(t, err, "dns.address-discovery.ip-family \"ipx\" is not supported, expected one of: ipv4, ipv6")
+}
@@ -0,0 +1,119 @@
+package address
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	metadataTokenTTL = time.Hour * 6
+)
+
+var metadataPaths = map[string]string{
+	"public-ipv4": "meta-data/public-ipv4",
+	"local-ipv4":  "meta-data/local-ipv4",
+	"ipv6":        "meta-data/ipv6",
+}
+
+// metadataSource reads the instance address from the EC2 instance metadata service using IMDSv2 session tokens.
+type metadataSource struct {
+	client      *http.Client
+	endpoint    string
+	path        string
+	token       string
+	tokenExpiry time.Time
+}
+
+func (m *metadataSource) Address(ctx context.Context) (string, error) {
+	token, err := m.sessionToken(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	body, status, err := m.do(ctx, http.MethodGet, m.path, map[string]string{"X-aws-ec2-metadata-token": token})
+	if err != nil {
+		return "", err
+	}
+
+	switch status {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		// token was revoked or expired early, request a new one on the next attempt
+		m.token = ""
+		return "", fmt.Errorf("instance metadata rejected session token")
+	case http.StatusNotFound:
+		return "", fmt.Errorf("instance metadata has no value for %s", m.path)
+	default:
+		return "", fmt.Errorf("instance metadata returned %d for %s", status, m.path)
+	}
+
+	// instances with several addresses return one per line, the first is the primary
+	return parseIP(strings.SplitN(strings.TrimSpace(body), "\n", 2)[0])
+}
+
+func (m *metadataSource) sessionToken(ctx context.Context) (string, error) {
+	if m.token != "" && time.Now().Before(m.tokenExpiry) {
+		return m.token, nil
+	}
+
+	body, status, err := m.do(ctx, http.MethodPut, "api/token", map[string]string{
+		"X-aws-ec2-metadata-token-ttl-seconds": fmt.Sprintf("%d", int(metadataTokenTTL.Seconds())),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if status != http.StatusOK {
+		return "", fmt.Errorf("unable to retrieve instance metadata session token: status %d", status)
+	}
+
+	m.token = strings.TrimSpace(body)
+	// refresh a little early so a token is never used right as it expires
+	m.tokenExpiry = time.Now().Add(metadataTokenTTL - time.Minute)
+
+	return m.token, nil
+}
+
+func (m *metadataSource) do(ctx context.Context, method, path string, headers map[string]string) (string, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, m.endpoint+"/latest/"+path, nil)
+	if err != nil {
+		return "", 0, err
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("unable to query instance metadata: %s", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, fmt.Errorf("unable to read instance metadata response: %s", err)
+	}
+
+	return string(data), resp.StatusCode, nil
+}
+
+func newMetadataSource(endpoint, addressType string) (*metadataSource, error) {
+	path, ok := metadataPaths[addressType]
+	if !ok {
+		return nil, fmt.Errorf("dns.address-discovery.address-type %q is not supported, expected one of: public-ipv4, local-ipv4, ipv6", addressType)
+	}
+
+	return &metadataSource{
+		client:   &http.Client{},
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		path:     path,
+	}, nil
+}
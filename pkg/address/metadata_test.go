@@ -0,0 +1,120 @@
+package address
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeMetadataService mimics the IMDSv2 endpoints: a token must be requested with PUT before metadata can be read.
+type fakeMetadataService struct {
+	values        map[string]string
+	tokenRequests int
+}
+
+func (f *fakeMetadataService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/latest/api/token" {
+		if r.Method != http.MethodPut || r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.tokenRequests++
+		fmt.Fprint(w, "token-abc")
+		return
+	}
+
+	if r.Header.Get("X-aws-ec2-metadata-token") != "token-abc" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	value, ok := f.values[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	fmt.Fprint(w, value)
+}
+
+func TestMetadataSource_Address(t *testing.T) {
+	fake := &fakeMetadataService{values: map[string]string{
+		"/latest/meta-data/public-ipv4": "203.0.113.7",
+		"/latest/meta-data/local-ipv4":  "10.0.1.20",
+		"/latest/meta-data/ipv6":        "2001:db8::7\n2001:db8::8",
+	}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	tests := map[string]struct {
+		addressType     string
+		expectedAddress string
+		expectedErr     error
+	}{
+		"returns public ipv4": {
+			"public-ipv4",
+			"203.0.113.7",
+			nil,
+		},
+		"returns local ipv4": {
+			"local-ipv4",
+			"10.0.1.20",
+			nil,
+		},
+		"returns primary ipv6": {
+			"ipv6",
+			"2001:db8::7",
+			nil,
+		},
+	}
+
+	for name, test := range tests {
+		src, err := newMetadataSource(srv.URL, test.addressType)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr, err := src.Address(context.Background())
+
+		assert.Equal(t, test.expectedErr, err, name)
+		assert.Equal(t, test.expectedAddress, addr, name)
+	}
+}
+
+func TestMetadataSource_reusesSessionToken(t *testing.T) {
+	fake := &fakeMetadataService{values: map[string]string{"/latest/meta-data/public-ipv4": "203.0.113.7"}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	src, _ := newMetadataSource(srv.URL, "public-ipv4")
+
+	for i := 0; i < 3; i++ {
+		_, err := src.Address(context.Background())
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, 1, fake.tokenRequests)
+}
+
+func TestMetadataSource_missingValue(t *testing.T) {
+	srv := httptest.NewServer(&fakeMetadataService{values: map[string]string{}})
+	defer srv.Close()
+
+	src, _ := newMetadataSource(srv.URL, "public-ipv4")
+
+	addr, err := src.Address(context.Background())
+
+	assert.Equal(t, errors.New("instance metadata has no value for meta-data/public-ipv4"), err)
+	assert.Equal(t, "", addr)
+}
+
+func TestNewMetadataSource(t *testing.T) {
+	_, err := newMetadataSource("http://169.254.169.254", "elastic-ip")
+
+	assert.EqualError(t, err, "dns.address-discovery.address-type \"elastic-ip\" is not supported, expected one of: public-ipv4, local-ipv4, ipv6")
+}
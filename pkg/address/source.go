@@ -0,0 +1,40 @@
+package address
+
+import (
+	"balanced/pkg/configuration"
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	requestTimeout = time.Second * 10
+)
+
+// Source resolves the address this instance should advertise in DNS.
+type Source interface {
+	Address(ctx context.Context) (string, error)
+}
+
+func NewSource(cfg *configuration.AddressDiscovery) (Source, error) {
+	switch cfg.Source {
+	case "ec2-metadata":
+		return newMetadataSource(cfg.MetadataEndpoint, cfg.AddressType)
+	case "interface":
+		return newInterfaceSource(cfg.Interface, cfg.IPFamily)
+	case "http":
+		return newHTTPSource(cfg.URL)
+	}
+
+	return nil, fmt.Errorf("dns.address-discovery.source %q is not supported, expected one of: ec2-metadata, interface, http", cfg.Source)
+}
+
+func parseIP(value string) (string, error) {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return "", fmt.Errorf("%q is not a valid ip address", value)
+	}
+
+	return ip.String(), nil
+}
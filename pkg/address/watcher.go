@@ -0,0 +1,78 @@
+package address
+
+import (
+	"balanced/pkg/configuration"
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Watcher periodically re-resolves the advertised address and reports when it changes.
+type Watcher struct {
+	source   Source
+	interval time.Duration
+	current  string
+}
+
+// Resolve looks up the current address and remembers it as the last known value.
+func (w *Watcher) Resolve(ctx context.Context) (string, error) {
+	addr, err := w.source.Address(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	w.current = addr
+
+	return addr, nil
+}
+
+// Start polls the source until stop is closed, sending the new address whenever it differs from the last known one.
+func (w *Watcher) Start(stop <-chan struct{}) <-chan string {
+	changes := make(chan string)
+
+	go func() {
+		defer close(changes)
+
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				previous := w.current
+
+				addr, err := w.Resolve(context.Background())
+				if err != nil {
+					log.Warnf("unable to resolve advertised address, keeping %s: %s", previous, err)
+					continue
+				}
+
+				if addr == previous {
+					continue
+				}
+
+				log.Infof("advertised address changed from %s to %s", previous, addr)
+
+				select {
+				case changes <- addr:
+				case <-stop:
+					return
+				}
+			}
+		}
+	}()
+
+	return changes
+}
+
+func NewWatcher(cfg *configuration.AddressDiscovery) (*Watcher, error) {
+	src, err := NewSource(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Watcher{source: src, interval: *cfg.RefreshInterval}, nil
+}
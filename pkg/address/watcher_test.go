@@ -0,0 +1,70 @@
+package address
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type stubSource struct {
+	mx        sync.Mutex
+	addresses []string
+	err       error
+}
+
+func (s *stubSource) Address(context.Context) (string, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.err != nil {
+		return "", s.err
+	}
+
+	addr := s.addresses[0]
+	if len(s.addresses) > 1 {
+		s.addresses = s.addresses[1:]
+	}
+
+	return addr, nil
+}
+
+func TestWatcher_StartReportsChangedAddress(t *testing.T) {
+	src := &stubSource{addresses: []string{"192.0.2.1", "192.0.2.1", "192.0.2.2"}}
+	w := &Watcher{source: src, interval: time.Millisecond}
+
+	addr, err := w.Resolve(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.1", addr)
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	select {
+	case changed := <-w.Start(stop):
+		assert.Equal(t, "192.0.2.2", changed)
+	case <-time.After(time.Second):
+		t.Fatal("expected address change to be reported")
+	}
+}
+
+func TestWatcher_StartKeepsAddressOnError(t *testing.T) {
+	src := &stubSource{err: errors.New("metadata unavailable")}
+	w := &Watcher{source: src, interval: time.Millisecond, current: "192.0.2.1"}
+
+	stop := make(chan struct{})
+	changes := w.Start(stop)
+
+	select {
+	case changed := <-changes:
+		t.Fatalf("unexpected address change to %s", changed)
+	case <-time.After(time.Millisecond * 20):
+	}
+
+	close(stop)
+
+	assert.Equal(t, "192.0.2.1", w.current)
+}
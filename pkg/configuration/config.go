@@ -1,6 +1,7 @@
 package configuration
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 	"time"
@@ -14,7 +15,58 @@ import (
 )
 
 var (
-	defaultSyncInterval = time.Second * 20
+	defaultSyncInterval            = time.Second * 20
+	defaultEmptyUpstreamPolicy     = EmptyUpstreamKeep
+	defaultBackendType             = BackendTypeFile
+	defaultRetryAttempts           = 3
+	defaultHistoryLimit            = 5
+	defaultRuntimeAPIBackend       = "{{.Domain}}"
+	defaultRuntimeAPITimeout       = time.Second * 5
+	defaultAggregateFile           = "balanced.cfg"
+	defaultAggregateMapBackend     = "{{.Domain}}"
+	defaultEnvoyListen             = ":18000"
+	defaultEnvoyRouteConfigName    = "balanced"
+	defaultEnvoyConnectTimeout     = time.Second * 5
+	defaultRoute53RecordType       = "A"
+	defaultRoute53TTL              = int64(60)
+	defaultAddressSource           = "ec2-metadata"
+	defaultAddressRefreshInterval  = time.Minute
+	defaultAddressType             = "public-ipv4"
+	defaultAddressMetadataEndpoint = "http://169.254.169.254"
+	defaultAddressIPFamily         = "ipv4"
+	defaultRFC2136TTL              = uint32(60)
+	defaultRFC2136TSIGAlgorithm    = "hmac-sha256"
+	defaultRFC2136Timeout          = time.Second * 10
+	defaultCloudflareTTL           = 1 // automatic
+	defaultCloudflareEndpoint      = "https://api.cloudflare.com/client/v4"
+	defaultLeaseName               = "balanced"
+	defaultLeaseNamespace          = "default"
+	defaultLeaseDuration           = time.Second * 15
+	defaultLeaseRenewDeadline      = time.Second * 10
+	defaultLeaseRetryPeriod        = time.Second * 2
+)
+
+const (
+	// EmptyUpstreamKeep leaves the last known servers in place when a service has no ready addresses.
+	EmptyUpstreamKeep = "keep"
+	// EmptyUpstreamEmpty renders the backend without servers so the template can serve a maintenance page.
+	EmptyUpstreamEmpty = "empty"
+	// EmptyUpstreamRemove removes the domain's configuration and DNS record entirely.
+	EmptyUpstreamRemove = "remove"
+)
+
+const (
+	// BackendTypeFile renders a configuration file per domain and runs reload-cmd.
+	BackendTypeFile = "file"
+	// BackendTypeEnvoy serves the upstreams to Envoy over xDS.
+	BackendTypeEnvoy = "envoy"
+)
+
+const (
+	// EndpointModeEndpoints discovers upstream servers from core/v1 Endpoints.
+	EndpointModeEndpoints = "endpoints"
+	// EndpointModeEndpointSlices discovers upstream servers from discovery.k8s.io/v1 EndpointSlices.
+	EndpointModeEndpointSlices = "endpointslices"
 )
 
 type Config struct {
@@ -29,9 +81,16 @@ type Cloud struct {
 }
 
 type AWS struct {
-	HostedZoneId string `toml:"route-53-hosted-zone-id"`
-	Type         string `toml:"route-53-record-type"`
-	TTL          int64  `toml:"route-53-ttl"`
+	Region        string         `toml:"region"`
+	HostedZoneId  string         `toml:"route-53-hosted-zone-id"`
+	Type          string         `toml:"route-53-record-type"`
+	TTL           int64          `toml:"route-53-ttl"`
+	Endpoint      string         `toml:"route-53-endpoint"`
+	WaitTimeout   *time.Duration `toml:"route-53-wait-timeout"`
+	RoutingPolicy string         `toml:"route-53-routing-policy"`
+	SetIdentifier string         `toml:"route-53-set-identifier"`
+	Weight        *int64         `toml:"route-53-weight"`
+	HealthCheckId string         `toml:"route-53-health-check-id"`
 }
 
 type CustomDNS struct {
@@ -39,19 +98,137 @@ type CustomDNS struct {
 	RemoveCommand string `toml:"remove-command"`
 }
 
+type AddressDiscovery struct {
+	Source           string         `toml:"source"`
+	RefreshInterval  *time.Duration `toml:"refresh-interval"`
+	AddressType      string         `toml:"address-type"`
+	MetadataEndpoint string         `toml:"metadata-endpoint"`
+	Interface        string         `toml:"interface"`
+	IPFamily         string         `toml:"ip-family"`
+	URL              string         `toml:"url"`
+}
+
+type RFC2136 struct {
+	Server        string         `toml:"server"`
+	Zone          string         `toml:"zone"`
+	TTL           uint32         `toml:"ttl"`
+	TSIGKeyName   string         `toml:"tsig-key-name"`
+	TSIGSecret    string         `toml:"tsig-secret"`
+	TSIGAlgorithm string         `toml:"tsig-algorithm"`
+	Timeout       *time.Duration `toml:"timeout"`
+}
+
+type Cloudflare struct {
+	APIToken       string          `toml:"api-token"`
+	ZoneId         string          `toml:"zone-id"`
+	TTL            int             `toml:"ttl"`
+	Proxied        bool            `toml:"proxied"`
+	ProxiedDomains map[string]bool `toml:"proxied-domains"`
+	Endpoint       string          `toml:"endpoint"`
+}
+
+// IsProxied reports whether traffic for domain should be proxied through Cloudflare,
+// per-domain settings take precedence over the zone wide default.
+func (c *Cloudflare) IsProxied(domain string) bool {
+	if proxied, ok := c.ProxiedDomains[domain]; ok {
+		return proxied
+	}
+
+	return c.Proxied
+}
+
+type DNSOwnership struct {
+	Enabled   bool   `toml:"enabled"`
+	TXTPrefix string `toml:"txt-prefix"`
+}
+
 type DNS struct {
-	Enabled          bool   `toml:"enabled"`
-	Address          string `toml:"advertised-address"`
-	UsePublicAddress bool   `toml:"use-public-address"`
+	Enabled           bool           `toml:"enabled"`
+	Address           string         `toml:"advertised-address"`
+	UsePublicAddress  bool           `toml:"use-public-address"`
+	ReconcileInterval *time.Duration `toml:"reconcile-interval"`
 
-	Custom *CustomDNS `toml:"custom"`
+	AddressDiscovery *AddressDiscovery `toml:"address-discovery"`
+	Ownership        *DNSOwnership     `toml:"ownership"`
+	RFC2136          *RFC2136          `toml:"rfc2136"`
+	Cloudflare       *Cloudflare       `toml:"cloudflare"`
+	Custom           *CustomDNS        `toml:"custom"`
 }
 
 type LoadBalancer struct {
-	ReconcileDuration *time.Duration `toml:"sync-interval"`
-	ConfigDir         string         `toml:"config-dir"`
-	ReloadCmd         string         `toml:"reload-cmd"`
-	Template          string         `toml:"template"`
+	Type                string         `toml:"type"`
+	ReconcileDuration   *time.Duration `toml:"sync-interval"`
+	ConfigDir           string         `toml:"config-dir"`
+	ReloadCmd           string         `toml:"reload-cmd"`
+	ValidateCmd         string         `toml:"validate-cmd"`
+	Template            string         `toml:"template"`
+	TemplateFile        string         `toml:"template-file"`
+	TemplateDir         string         `toml:"template-dir"`
+	EmptyUpstreamPolicy string         `toml:"empty-upstream-policy"`
+	RetryAttempts       *int           `toml:"retry-attempts"`
+	HistoryLimit        *int           `toml:"history-limit"`
+
+	RuntimeAPI *RuntimeAPI `toml:"runtime-api"`
+	Aggregate  *Aggregate  `toml:"aggregate"`
+	Envoy      *Envoy      `toml:"envoy"`
+}
+
+// TemplateText returns the template, read from template-file when set.
+func (l *LoadBalancer) TemplateText() (string, error) {
+	if l.TemplateFile == "" {
+		return l.Template, nil
+	}
+
+	if l.Template != "" {
+		return "", errors.New("loadbalancer: only one of template and template-file can be set")
+	}
+
+	data, err := os.ReadFile(l.TemplateFile)
+	if err != nil {
+		return "", fmt.Errorf("loadbalancer.template-file: %s", err)
+	}
+
+	return string(data), nil
+}
+
+// Aggregate configures rendering every domain into a single file, and optionally a map file of
+// domain to backend, instead of a file per domain.
+type Aggregate struct {
+	Enabled    bool   `toml:"enabled"`
+	File       string `toml:"file"`
+	MapFile    string `toml:"map-file"`
+	MapBackend string `toml:"map-backend"`
+}
+
+// Envoy configures the xDS server used when the load balancer type is envoy.
+type Envoy struct {
+	Listen          string         `toml:"listen"`
+	RouteConfigName string         `toml:"route-config-name"`
+	ConnectTimeout  *time.Duration `toml:"connect-timeout"`
+	UpstreamTLS     bool           `toml:"upstream-tls"`
+}
+
+func (e *Envoy) setDefaults() {
+	if e.Listen == "" {
+		e.Listen = defaultEnvoyListen
+	}
+
+	if e.RouteConfigName == "" {
+		e.RouteConfigName = defaultEnvoyRouteConfigName
+	}
+
+	if e.ConnectTimeout == nil {
+		e.ConnectTimeout = &defaultEnvoyConnectTimeout
+	}
+}
+
+// RuntimeAPI configures updating servers through the HAProxy stats socket instead of reloading.
+type RuntimeAPI struct {
+	Enabled       bool           `toml:"enabled"`
+	Address       string         `toml:"address"`
+	Backend       string         `toml:"backend"`
+	ServerOptions string         `toml:"server-options"`
+	Timeout       *time.Duration `toml:"timeout"`
 }
 
 type KubeConfig struct {
@@ -60,6 +237,20 @@ type KubeConfig struct {
 	ServiceAnnotationLoadBalancerId string   `toml:"service-annotation-load-balancer-id"`
 	WatchedNamespaces               []string `toml:"watch-namespaces"`
 	ExcludedNamespaces              []string `toml:"exclude-namespaces"`
+	EndpointMode                    string   `toml:"endpoint-mode"`
+
+	LeaderElection *LeaderElection `toml:"leader-election"`
+}
+
+// LeaderElection configures the Lease used to elect which of several instances manages DNS records.
+type LeaderElection struct {
+	Enabled        bool           `toml:"enabled"`
+	LeaseName      string         `toml:"lease-name"`
+	LeaseNamespace string         `toml:"lease-namespace"`
+	Identity       string         `toml:"identity"`
+	LeaseDuration  *time.Duration `toml:"lease-duration"`
+	RenewDeadline  *time.Duration `toml:"renew-deadline"`
+	RetryPeriod    *time.Duration `toml:"retry-period"`
 }
 
 func (k *KubeConfig) DomainAnnotationKey() string {
@@ -72,6 +263,29 @@ func (k *KubeConfig) HealthCheckAnnotationKey() string {
 	return fmt.Sprintf("%s/health-check", prefix)
 }
 
+// AnnotationKeyPrefix returns the prefix, including the trailing slash, of the annotations read by balanced.
+func (k *KubeConfig) AnnotationKeyPrefix() string {
+	return strings.TrimSuffix(k.ServiceAnnotationKeyPrefix, "/") + "/"
+}
+
+// WeightAnnotationKey is read from the pods behind a service, setting the weight of their servers.
+func (k *KubeConfig) WeightAnnotationKey() string {
+	prefix := strings.TrimSuffix(k.ServiceAnnotationKeyPrefix, "/")
+	return fmt.Sprintf("%s/weight", prefix)
+}
+
+// BackupAnnotationKey is read from the pods behind a service, marking their servers as backups.
+func (k *KubeConfig) BackupAnnotationKey() string {
+	prefix := strings.TrimSuffix(k.ServiceAnnotationKeyPrefix, "/")
+	return fmt.Sprintf("%s/backup", prefix)
+}
+
+// TemplateAnnotationKey names a template from template-dir to render the service's domains with.
+func (k *KubeConfig) TemplateAnnotationKey() string {
+	prefix := strings.TrimSuffix(k.ServiceAnnotationKeyPrefix, "/")
+	return fmt.Sprintf("%s/template", prefix)
+}
+
 func (k *KubeConfig) LoadBalancerIdAnnotationKey() string {
 	prefix := strings.TrimSuffix(k.ServiceAnnotationKeyPrefix, "/")
 	return fmt.Sprintf("%s/load-balancer-id", prefix)
@@ -90,6 +304,54 @@ func (k *KubeConfig) GetConfigPath() string {
 	return filepath.Join(home, ".kube", "config")
 }
 
+func (l *LeaderElection) setDefaults() {
+	if l.LeaseName == "" {
+		l.LeaseName = defaultLeaseName
+	}
+
+	if l.LeaseNamespace == "" {
+		l.LeaseNamespace = defaultLeaseNamespace
+	}
+
+	if l.Identity == "" {
+		l.Identity, _ = os.Hostname()
+	}
+
+	if l.LeaseDuration == nil {
+		l.LeaseDuration = &defaultLeaseDuration
+	}
+
+	if l.RenewDeadline == nil {
+		l.RenewDeadline = &defaultLeaseRenewDeadline
+	}
+
+	if l.RetryPeriod == nil {
+		l.RetryPeriod = &defaultLeaseRetryPeriod
+	}
+}
+
+func (a *AddressDiscovery) setDefaults() {
+	if a.Source == "" {
+		a.Source = defaultAddressSource
+	}
+
+	if a.RefreshInterval == nil {
+		a.RefreshInterval = &defaultAddressRefreshInterval
+	}
+
+	if a.AddressType == "" {
+		a.AddressType = defaultAddressType
+	}
+
+	if a.MetadataEndpoint == "" {
+		a.MetadataEndpoint = defaultAddressMetadataEndpoint
+	}
+
+	if a.IPFamily == "" {
+		a.IPFamily = defaultAddressIPFamily
+	}
+}
+
 func New(path string) (*Config, error) {
 	var cfg Config
 	_, err := toml.DecodeFile(path, &cfg)
@@ -100,5 +362,98 @@ func New(path string) (*Config, error) {
 	if cfg.LoadBalancer != nil && cfg.LoadBalancer.ReconcileDuration == nil {
 		cfg.LoadBalancer.ReconcileDuration = &defaultSyncInterval
 	}
+
+	if cfg.LoadBalancer != nil && cfg.LoadBalancer.Type == "" {
+		cfg.LoadBalancer.Type = defaultBackendType
+	}
+
+	if cfg.LoadBalancer != nil && cfg.LoadBalancer.EmptyUpstreamPolicy == "" {
+		cfg.LoadBalancer.EmptyUpstreamPolicy = defaultEmptyUpstreamPolicy
+	}
+
+	if cfg.LoadBalancer != nil && cfg.LoadBalancer.RetryAttempts == nil {
+		cfg.LoadBalancer.RetryAttempts = &defaultRetryAttempts
+	}
+
+	if cfg.LoadBalancer != nil && cfg.LoadBalancer.HistoryLimit == nil {
+		cfg.LoadBalancer.HistoryLimit = &defaultHistoryLimit
+	}
+
+	if cfg.LoadBalancer != nil && cfg.LoadBalancer.Type == BackendTypeEnvoy {
+		if cfg.LoadBalancer.Envoy == nil {
+			cfg.LoadBalancer.Envoy = &Envoy{}
+		}
+		cfg.LoadBalancer.Envoy.setDefaults()
+	}
+
+	if cfg.LoadBalancer != nil && cfg.LoadBalancer.RuntimeAPI != nil {
+		if cfg.LoadBalancer.RuntimeAPI.Backend == "" {
+			cfg.LoadBalancer.RuntimeAPI.Backend = defaultRuntimeAPIBackend
+		}
+
+		if cfg.LoadBalancer.RuntimeAPI.Timeout == nil {
+			cfg.LoadBalancer.RuntimeAPI.Timeout = &defaultRuntimeAPITimeout
+		}
+	}
+
+	if cfg.LoadBalancer != nil && cfg.LoadBalancer.Aggregate != nil {
+		if cfg.LoadBalancer.Aggregate.File == "" {
+			cfg.LoadBalancer.Aggregate.File = defaultAggregateFile
+		}
+
+		if cfg.LoadBalancer.Aggregate.MapBackend == "" {
+			cfg.LoadBalancer.Aggregate.MapBackend = defaultAggregateMapBackend
+		}
+	}
+
+	if cfg.Kubernetes != nil && cfg.Kubernetes.LeaderElection != nil {
+		cfg.Kubernetes.LeaderElection.setDefaults()
+	}
+
+	if cfg.DNS.UsePublicAddress {
+		if cfg.DNS.AddressDiscovery == nil {
+			cfg.DNS.AddressDiscovery = &AddressDiscovery{}
+		}
+		cfg.DNS.AddressDiscovery.setDefaults()
+	}
+
+	if rfc := cfg.DNS.RFC2136; rfc != nil {
+		if rfc.TTL == 0 {
+			rfc.TTL = defaultRFC2136TTL
+		}
+
+		if rfc.TSIGAlgorithm == "" {
+			rfc.TSIGAlgorithm = defaultRFC2136TSIGAlgorithm
+		}
+
+		if rfc.Timeout == nil {
+			rfc.Timeout = &defaultRFC2136Timeout
+		}
+	}
+
+	if cf := cfg.DNS.Cloudflare; cf != nil {
+		if cf.TTL == 0 {
+			cf.TTL = defaultCloudflareTTL
+		}
+
+		if cf.Endpoint == "" {
+			cf.Endpoint = defaultCloudflareEndpoint
+		}
+
+		if cf.APIToken == "" {
+			cf.APIToken = os.Getenv("CLOUDFLARE_API_TOKEN")
+		}
+	}
+
+	if aws := cfg.Cloud.AWS; aws != nil {
+		if aws.Type == "" {
+			aws.Type = defaultRoute53RecordType
+		}
+
+		if aws.TTL == 0 {
+			aws.TTL = defaultRoute53TTL
+		}
+	}
+
 	return &cfg, nil
 }
@@ -106,6 +106,40 @@ func TestConfig_New(t *testing.T) {
 			nil,
 			&Config{DNS: DNS{Enabled: true, Custom: &CustomDNS{AddCommand: "dns.sh add something"}}},
 		},
+		"returns config object with route 53 defaults applied": {
+			func() (string, error) {
+				data := "[cloud.aws]\nroute-53-hosted-zone-id = \"Z123\""
+				f, err := createTempFile(data)
+				if err != nil {
+					return "", err
+				}
+
+				defer f.Close()
+				return f.Name(), nil
+			},
+			nil,
+			&Config{Cloud: Cloud{AWS: &AWS{HostedZoneId: "Z123", Type: "A", TTL: 60}}},
+		},
+		"returns config object with address discovery defaults when use-public-address is set": {
+			func() (string, error) {
+				data := "[dns]\nuse-public-address = true"
+				f, err := createTempFile(data)
+				if err != nil {
+					return "", err
+				}
+
+				defer f.Close()
+				return f.Name(), nil
+			},
+			nil,
+			&Config{DNS: DNS{UsePublicAddress: true, AddressDiscovery: &AddressDiscovery{
+				Source:           "ec2-metadata",
+				RefreshInterval:  &defaultAddressRefreshInterval,
+				AddressType:      "public-ipv4",
+				MetadataEndpoint: "http://169.254.169.254",
+				IPFamily:         "ipv4",
+			}}},
+		},
 	}
 
 	for name, test := range tests {
@@ -122,3 +156,41 @@ func TestConfig_New(t *testing.T) {
 		assert.Equal(t, test.expectedCfg, cfg, name)
 	}
 }
+
+func TestLoadBalancer_TemplateText(t *testing.T) {
+	f, err := createTempFile("backend {{.Domain}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	tests := map[string]struct {
+		lb           *LoadBalancer
+		expectedText string
+		expectedErr  error
+	}{
+		"returns inline template": {
+			&LoadBalancer{Template: "inline"},
+			"inline",
+			nil,
+		},
+		"reads template file": {
+			&LoadBalancer{TemplateFile: f.Name()},
+			"backend {{.Domain}}",
+			nil,
+		},
+		"returns error when both are set": {
+			&LoadBalancer{Template: "inline", TemplateFile: f.Name()},
+			"",
+			errors.New("loadbalancer: only one of template and template-file can be set"),
+		},
+	}
+
+	for name, test := range tests {
+		text, err := test.lb.TemplateText()
+
+		assert.Equal(t, test.expectedErr, err, name)
+		assert.Equal(t, test.expectedText, text, name)
+	}
+}
@@ -0,0 +1,413 @@
+package dns
+
+import (
+	"balanced/pkg/configuration"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	cloudflareRequestTimeout = time.Second * 30
+)
+
+type cloudflareRecord struct {
+	Id      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+	Proxied *bool  `json:"proxied,omitempty"`
+}
+
+type cloudflareAPIError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type cloudflareResponse struct {
+	Success bool                 `json:"success"`
+	Errors  []cloudflareAPIError `json:"errors"`
+	Result  json.RawMessage      `json:"result"`
+}
+
+// CloudflareError is returned when the Cloudflare API rejects a request.
+type CloudflareError struct {
+	Status int
+	Code   int
+	msg    string
+}
+
+func (e *CloudflareError) Error() string {
+	return e.msg
+}
+
+// CloudflareRegistrar keeps one record per domain in a Cloudflare zone pointing at the advertised
+// address, updating an existing record in place rather than adding another one next to it.
+type CloudflareRegistrar struct {
+	client       *http.Client
+	endpoint     string
+	token        string
+	zoneId       string
+	ttl          int
+	cfg          *configuration.Cloudflare
+	address      string
+	ownership    bool
+	txtPrefix    string
+	knownDomains map[string]Owner
+}
+
+func (c *CloudflareRegistrar) Add(domain string, owner Owner) error {
+	if current, known := c.knownDomains[domain]; known && current == owner {
+		log.Debugf("already know about %s, no action", domain)
+		return nil
+	}
+
+	if err := c.verifyOwnership(domain, owner); err != nil {
+		return err
+	}
+
+	if err := c.upsert(c.addressRecord(domain)); err != nil {
+		return err
+	}
+
+	if c.ownership {
+		if err := c.upsert(c.ownershipRecord(domain, owner)); err != nil {
+			return err
+		}
+	}
+
+	c.knownDomains[domain] = owner
+
+	return nil
+}
+
+// AddAll registers each domain in turn, the API has no way to change several records at once.
+func (c *CloudflareRegistrar) AddAll(owners map[string]Owner) map[string]error {
+	return addEach(c.Add, owners)
+}
+
+func (c *CloudflareRegistrar) Remove(domain string) error {
+	owner, known := c.knownDomains[domain]
+	if !known {
+		return nil
+	}
+
+	if err := c.verifyOwnership(domain, owner); err != nil {
+		return err
+	}
+
+	if err := c.delete(c.addressRecord(domain)); err != nil {
+		return err
+	}
+
+	if c.ownership {
+		if err := c.delete(c.ownershipRecord(domain, owner)); err != nil {
+			return err
+		}
+	}
+
+	delete(c.knownDomains, domain)
+
+	return nil
+}
+
+func (c *CloudflareRegistrar) RemoveAll() error {
+	errors := make([]string, 0)
+	for domain := range c.knownDomains {
+		if err := c.Remove(domain); err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("one or more errors occurred: %s", strings.Join(errors, "\n"))
+	}
+
+	return nil
+}
+
+func (c *CloudflareRegistrar) SetAddress(address string) error {
+	if address == c.address {
+		return nil
+	}
+
+	previous := c.address
+	c.address = address
+
+	errors := make([]string, 0)
+	for domain := range c.knownDomains {
+		if err := c.upsert(c.addressRecord(domain)); err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+
+	if len(errors) > 0 {
+		// keep the previous address so that retrying re-applies every record
+		c.address = previous
+		return fmt.Errorf("one or more errors occurred: %s", strings.Join(errors, "\n"))
+	}
+
+	return nil
+}
+
+// Reconcile re-applies the records of every known domain, updating any that were changed or
+// deleted outside of balanced unless somebody else has since claimed them.
+func (c *CloudflareRegistrar) Reconcile() error {
+	errors := make([]string, 0)
+	for domain, owner := range c.knownDomains {
+		if c.ownership {
+			txtRecords, err := c.list("TXT", ownershipRecordName(c.txtPrefix, domain))
+			if err != nil {
+				errors = append(errors, err.Error())
+				continue
+			}
+
+			txtValues := make([]string, 0, len(txtRecords))
+			for _, rec := range txtRecords {
+				txtValues = append(txtValues, rec.Content)
+			}
+
+			if _, err := claimedBy(domain, owner, txtValues); err != nil {
+				errors = append(errors, err.Error())
+				continue
+			}
+		}
+
+		if err := c.upsert(c.addressRecord(domain)); err != nil {
+			errors = append(errors, err.Error())
+			continue
+		}
+
+		if c.ownership {
+			if err := c.upsert(c.ownershipRecord(domain, owner)); err != nil {
+				errors = append(errors, err.Error())
+			}
+		}
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("one or more errors occurred: %s", strings.Join(errors, "\n"))
+	}
+
+	return nil
+}
+
+func (c *CloudflareRegistrar) addressRecord(domain string) *cloudflareRecord {
+	recordType := "A"
+	if ip := net.ParseIP(c.address); ip != nil && ip.To4() == nil {
+		recordType = "AAAA"
+	}
+
+	proxied := c.cfg.IsProxied(domain)
+
+	// cloudflare always sets proxied records to automatic, asking for another ttl would never match
+	ttl := c.ttl
+	if proxied {
+		ttl = 1
+	}
+
+	return &cloudflareRecord{Type: recordType, Name: domain, Content: c.address, TTL: ttl, Proxied: &proxied}
+}
+
+func (c *CloudflareRegistrar) ownershipRecord(domain string, owner Owner) *cloudflareRecord {
+	return &cloudflareRecord{Type: "TXT", Name: ownershipRecordName(c.txtPrefix, domain), Content: owner.String(), TTL: c.ttl}
+}
+
+// upsert updates the first existing record with the same name and type, only creating one when none exist.
+func (c *CloudflareRegistrar) upsert(desired *cloudflareRecord) error {
+	existing, err := c.list(desired.Type, desired.Name)
+	if err != nil {
+		return err
+	}
+
+	if len(existing) == 0 {
+		log.Infof("creating cloudflare %s record for %s: %s", desired.Type, desired.Name, desired.Content)
+		return c.do(http.MethodPost, "dns_records", desired, nil)
+	}
+
+	current := existing[0]
+	if contentEqual(current.Content, desired.Content) && current.TTL == desired.TTL && proxiedEqual(current.Proxied, desired.Proxied) {
+		log.Debugf("cloudflare %s record for %s is already up to date", desired.Type, desired.Name)
+		return nil
+	}
+
+	log.Infof("updating cloudflare %s record %s for %s: %s ttl=%d -> %s ttl=%d", desired.Type, current.Id, desired.Name, current.Content, current.TTL, desired.Content, desired.TTL)
+	return c.do(http.MethodPut, "dns_records/"+current.Id, desired, nil)
+}
+
+// delete removes records with the same name, type and content, leaving records pointing elsewhere untouched.
+func (c *CloudflareRegistrar) delete(desired *cloudflareRecord) error {
+	existing, err := c.list(desired.Type, desired.Name)
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range existing {
+		if !contentEqual(rec.Content, desired.Content) {
+			continue
+		}
+
+		if err := c.do(http.MethodDelete, "dns_records/"+rec.Id, nil, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *CloudflareRegistrar) list(recordType, name string) ([]*cloudflareRecord, error) {
+	query := url.Values{"type": {recordType}, "name": {name}}
+
+	records := make([]*cloudflareRecord, 0)
+	if err := c.do(http.MethodGet, "dns_records?"+query.Encode(), nil, &records); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+func (c *CloudflareRegistrar) verifyOwnership(domain string, owner Owner) error {
+	if !c.ownership {
+		return nil
+	}
+
+	txtRecords, err := c.list("TXT", ownershipRecordName(c.txtPrefix, domain))
+	if err != nil {
+		return err
+	}
+
+	txtValues := make([]string, 0, len(txtRecords))
+	for _, rec := range txtRecords {
+		txtValues = append(txtValues, rec.Content)
+	}
+
+	addressRecords, err := c.list(c.addressRecord(domain).Type, domain)
+	if err != nil {
+		return err
+	}
+
+	return checkOwnership(domain, owner, txtValues, len(addressRecords) > 0)
+}
+
+func (c *CloudflareRegistrar) do(method, path string, body interface{}, result interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/zones/%s/%s", c.endpoint, c.zoneId, path), reqBody)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to reach cloudflare api: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var cfResp cloudflareResponse
+	if err := json.NewDecoder(resp.Body).Decode(&cfResp); err != nil {
+		return &CloudflareError{Status: resp.StatusCode, msg: fmt.Sprintf("cloudflare api returned an unreadable %d response: %s", resp.StatusCode, err)}
+	}
+
+	if !cfResp.Success || resp.StatusCode >= 300 {
+		return c.describeError(resp.StatusCode, cfResp.Errors)
+	}
+
+	if result != nil {
+		return json.Unmarshal(cfResp.Result, result)
+	}
+
+	return nil
+}
+
+// describeError turns the Cloudflare error payload into a message that points at the likely cause.
+func (c *CloudflareRegistrar) describeError(status int, apiErrors []cloudflareAPIError) error {
+	e := &CloudflareError{Status: status}
+
+	detail := "no error details returned"
+	if len(apiErrors) > 0 {
+		e.Code = apiErrors[0].Code
+		detail = fmt.Sprintf("%d: %s", apiErrors[0].Code, apiErrors[0].Message)
+	}
+
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden || e.Code == 9109 || e.Code == 10000:
+		e.msg = fmt.Sprintf("cloudflare rejected the api token, check dns.cloudflare.api-token has DNS edit permission on zone %s (%s)", c.zoneId, detail)
+	case e.Code == 7003 || e.Code == 7000 || status == http.StatusNotFound:
+		e.msg = fmt.Sprintf("cloudflare zone %s or record could not be found, check dns.cloudflare.zone-id (%s)", c.zoneId, detail)
+	case e.Code == 81053 || e.Code == 81057 || e.Code == 81058:
+		e.msg = fmt.Sprintf("cloudflare refused to create a conflicting record (%s)", detail)
+	case e.Code == 1004 || e.Code == 9005:
+		e.msg = fmt.Sprintf("cloudflare rejected the record as invalid (%s)", detail)
+	case status == http.StatusTooManyRequests:
+		e.msg = fmt.Sprintf("cloudflare api rate limit exceeded (%s)", detail)
+	default:
+		e.msg = fmt.Sprintf("cloudflare api request failed with status %d (%s)", status, detail)
+	}
+
+	return e
+}
+
+// contentEqual compares record content, ignoring the quotes Cloudflare may add around TXT values.
+func contentEqual(a, b string) bool {
+	return strings.Trim(a, `"`) == strings.Trim(b, `"`)
+}
+
+func proxiedEqual(a, b *bool) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return *a == *b
+}
+
+func NewCloudflareRegistrar(cfg *configuration.Cloudflare, dnsCfg *configuration.DNS) (*CloudflareRegistrar, error) {
+	if cfg.APIToken == "" {
+		return nil, errors.New("dns.cloudflare.api-token not set in config or CLOUDFLARE_API_TOKEN")
+	}
+
+	if cfg.ZoneId == "" {
+		return nil, errors.New("dns.cloudflare.zone-id not set in config")
+	}
+
+	if dnsCfg.Address == "" {
+		return nil, errors.New("dns.advertised-address not set in config")
+	}
+
+	c := &CloudflareRegistrar{
+		client:       &http.Client{Timeout: cloudflareRequestTimeout},
+		endpoint:     strings.TrimSuffix(cfg.Endpoint, "/"),
+		token:        cfg.APIToken,
+		zoneId:       cfg.ZoneId,
+		ttl:          cfg.TTL,
+		cfg:          cfg,
+		address:      dnsCfg.Address,
+		knownDomains: make(map[string]Owner),
+	}
+
+	if dnsCfg.Ownership != nil && dnsCfg.Ownership.Enabled {
+		c.ownership = true
+		c.txtPrefix = dnsCfg.Ownership.TXTPrefix
+	}
+
+	return c, nil
+}
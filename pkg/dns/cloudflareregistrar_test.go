@@ -0,0 +1,248 @@
+package dns
+
+import (
+	"balanced/pkg/configuration"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeCloudflare is a stand-in for the Cloudflare v4 DNS records API of a single zone.
+type fakeCloudflare struct {
+	mx       sync.Mutex
+	records  map[string]*cloudflareRecord
+	nextId   int
+	requests []string
+	failWith *cloudflareAPIError
+}
+
+func (f *fakeCloudflare) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	f.requests = append(f.requests, r.Method)
+
+	if r.Header.Get("Authorization") != "Bearer token" {
+		f.respond(w, http.StatusForbidden, nil, &cloudflareAPIError{Code: 9109, Message: "Invalid access token"})
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, "/zones/zone-1/dns_records") {
+		f.respond(w, http.StatusBadRequest, nil, &cloudflareAPIError{Code: 7003, Message: "Could not route to /zones, perhaps your object identifier is invalid?"})
+		return
+	}
+
+	if f.failWith != nil {
+		f.respond(w, http.StatusBadRequest, nil, f.failWith)
+		return
+	}
+
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/zones/zone-1/dns_records"), "/")
+
+	switch r.Method {
+	case http.MethodGet:
+		result := make([]*cloudflareRecord, 0)
+		for _, rec := range f.records {
+			if rec.Type == r.URL.Query().Get("type") && rec.Name == r.URL.Query().Get("name") {
+				result = append(result, rec)
+			}
+		}
+		f.respond(w, http.StatusOK, result, nil)
+	case http.MethodPost, http.MethodPut:
+		var rec cloudflareRecord
+		json.NewDecoder(r.Body).Decode(&rec)
+		if id == "" {
+			f.nextId++
+			id = fmt.Sprintf("rec-%d", f.nextId)
+		}
+		rec.Id = id
+		if rec.Proxied != nil && *rec.Proxied {
+			rec.TTL = 1
+		}
+		f.records[id] = &rec
+		f.respond(w, http.StatusOK, rec, nil)
+	case http.MethodDelete:
+		delete(f.records, id)
+		f.respond(w, http.StatusOK, map[string]string{"id": id}, nil)
+	}
+}
+
+func (f *fakeCloudflare) respond(w http.ResponseWriter, status int, result interface{}, apiErr *cloudflareAPIError) {
+	resp := map[string]interface{}{"success": apiErr == nil, "errors": []*cloudflareAPIError{}, "result": result}
+	if apiErr != nil {
+		resp["errors"] = []*cloudflareAPIError{apiErr}
+	}
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func newTestCloudflareRegistrar(t *testing.T, cfg *configuration.Cloudflare) (*CloudflareRegistrar, *fakeCloudflare) {
+	fake := &fakeCloudflare{records: make(map[string]*cloudflareRecord)}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	cfg.Endpoint = srv.URL
+	if cfg.APIToken == "" {
+		cfg.APIToken = "token"
+	}
+	if cfg.ZoneId == "" {
+		cfg.ZoneId = "zone-1"
+	}
+
+	c, err := NewCloudflareRegistrar(cfg, &configuration.DNS{Address: "192.0.2.10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c, fake
+}
+
+func TestNewCloudflareRegistrar(t *testing.T) {
+	tests := map[string]struct {
+		cfg         *configuration.Cloudflare
+		expectedErr string
+	}{
+		"returns error when api token is not set": {
+			&configuration.Cloudflare{ZoneId: "zone-1"},
+			"dns.cloudflare.api-token not set in config or CLOUDFLARE_API_TOKEN",
+		},
+		"returns error when zone id is not set": {
+			&configuration.Cloudflare{APIToken: "token"},
+			"dns.cloudflare.zone-id not set in config",
+		},
+	}
+
+	for name, test := range tests {
+		_, err := NewCloudflareRegistrar(test.cfg, &configuration.DNS{Address: "192.0.2.10"})
+
+		assert.EqualError(t, err, test.expectedErr, name)
+	}
+}
+
+func TestCloudflareRegistrar_Add(t *testing.T) {
+	c, fake := newTestCloudflareRegistrar(t, &configuration.Cloudflare{TTL: 1, ProxiedDomains: map[string]bool{"foo.example.com": true}})
+
+	assert.NoError(t, c.Add("foo.example.com", testOwner))
+	assert.NoError(t, c.Add("bar.example.com", testOwner))
+
+	proxied, notProxied := true, false
+	assert.Equal(t, map[string]*cloudflareRecord{
+		"rec-1": {Id: "rec-1", Type: "A", Name: "foo.example.com", Content: "192.0.2.10", TTL: 1, Proxied: &proxied},
+		"rec-2": {Id: "rec-2", Type: "A", Name: "bar.example.com", Content: "192.0.2.10", TTL: 1, Proxied: &notProxied},
+	}, fake.records)
+}
+
+func TestCloudflareRegistrar_AddUpdatesExistingRecordInPlace(t *testing.T) {
+	c, fake := newTestCloudflareRegistrar(t, &configuration.Cloudflare{TTL: 1})
+	fake.records["existing"] = &cloudflareRecord{Id: "existing", Type: "A", Name: "foo.example.com", Content: "192.0.2.99", TTL: 300}
+
+	assert.NoError(t, c.Add("foo.example.com", testOwner))
+
+	assert.Len(t, fake.records, 1, "existing record should be updated instead of duplicated")
+	assert.Equal(t, "192.0.2.10", fake.records["existing"].Content)
+	assert.Equal(t, []string{"GET", "PUT"}, fake.requests)
+
+	fake.requests = nil
+	delete(c.knownDomains, "foo.example.com")
+
+	assert.NoError(t, c.Add("foo.example.com", testOwner))
+	assert.Equal(t, []string{"GET"}, fake.requests, "up to date records should not be written")
+}
+
+func TestCloudflareRegistrar_Reconcile(t *testing.T) {
+	c, fake := newTestCloudflareRegistrar(t, &configuration.Cloudflare{TTL: 1})
+
+	assert.NoError(t, c.Add("foo.example.com", testOwner))
+	fake.records["rec-1"].Content = "192.0.2.99"
+
+	assert.NoError(t, c.Reconcile())
+	assert.Len(t, fake.records, 1, "drifted record should be updated in place")
+	assert.Equal(t, "192.0.2.10", fake.records["rec-1"].Content)
+
+	delete(fake.records, "rec-1")
+
+	assert.NoError(t, c.Reconcile())
+	assert.Equal(t, "192.0.2.10", fake.records["rec-2"].Content)
+}
+
+func TestCloudflareRegistrar_ReconcileLeavesProxiedTTL(t *testing.T) {
+	c, fake := newTestCloudflareRegistrar(t, &configuration.Cloudflare{TTL: 300, ProxiedDomains: map[string]bool{"foo.example.com": true}})
+
+	assert.NoError(t, c.Add("foo.example.com", testOwner))
+	assert.Equal(t, 1, fake.records["rec-1"].TTL)
+
+	fake.requests = nil
+
+	assert.NoError(t, c.Reconcile())
+	assert.Equal(t, []string{"GET"}, fake.requests, "proxied records with automatic ttl should not be rewritten")
+}
+
+func TestCloudflareRegistrar_RemoveOnlyDeletesOwnAddress(t *testing.T) {
+	c, fake := newTestCloudflareRegistrar(t, &configuration.Cloudflare{TTL: 1})
+	fake.records["other"] = &cloudflareRecord{Id: "other", Type: "A", Name: "foo.example.com", Content: "192.0.2.99", TTL: 1}
+	fake.records["mine"] = &cloudflareRecord{Id: "mine", Type: "A", Name: "foo.example.com", Content: "192.0.2.10", TTL: 1}
+	c.knownDomains["foo.example.com"] = testOwner
+
+	assert.NoError(t, c.RemoveAll())
+
+	assert.Contains(t, fake.records, "other")
+	assert.NotContains(t, fake.records, "mine")
+	assert.Empty(t, c.knownDomains)
+}
+
+func TestCloudflareRegistrar_errors(t *testing.T) {
+	tests := map[string]struct {
+		cfg         *configuration.Cloudflare
+		failWith    *cloudflareAPIError
+		expectedErr string
+	}{
+		"explains invalid token": {
+			&configuration.Cloudflare{APIToken: "wrong"},
+			nil,
+			"cloudflare rejected the api token, check dns.cloudflare.api-token has DNS edit permission on zone zone-1 (9109: Invalid access token)",
+		},
+		"explains unknown zone": {
+			&configuration.Cloudflare{ZoneId: "zone-2"},
+			nil,
+			"cloudflare zone zone-2 or record could not be found, check dns.cloudflare.zone-id (7003: Could not route to /zones, perhaps your object identifier is invalid?)",
+		},
+		"explains conflicting record": {
+			&configuration.Cloudflare{},
+			&cloudflareAPIError{Code: 81053, Message: "An A, AAAA, or CNAME record with that host already exists."},
+			"cloudflare refused to create a conflicting record (81053: An A, AAAA, or CNAME record with that host already exists.)",
+		},
+	}
+
+	for name, test := range tests {
+		c, fake := newTestCloudflareRegistrar(t, test.cfg)
+		fake.failWith = test.failWith
+
+		err := c.Add("foo.example.com", testOwner)
+
+		var cfErr *CloudflareError
+		assert.ErrorAs(t, err, &cfErr, name)
+		assert.EqualError(t, err, test.expectedErr, name)
+	}
+}
+
+func TestCloudflareRegistrar_ownership(t *testing.T) {
+	c, fake := newTestCloudflareRegistrar(t, &configuration.Cloudflare{TTL: 1})
+	c.ownership = true
+	fake.records["foreign"] = &cloudflareRecord{Id: "foreign", Type: "A", Name: "foo.example.com", Content: "192.0.2.99", TTL: 1}
+
+	err := c.Add("foo.example.com", testOwner)
+
+	var ownershipErr *OwnershipError
+	assert.ErrorAs(t, err, &ownershipErr)
+	assert.Len(t, fake.records, 1)
+
+	assert.NoError(t, c.Add("bar.example.com", testOwner))
+	assert.Len(t, fake.records, 3, "ownership txt record should be written alongside the address")
+}
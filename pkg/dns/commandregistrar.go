@@ -22,7 +22,7 @@ type CommandRegistrar struct {
 	knownDomains  types.Set[string]
 }
 
-func (c *CommandRegistrar) Add(domain string) error {
+func (c *CommandRegistrar) Add(domain string, _ Owner) error {
 	if c.knownDomains.Has(domain) {
 		log.Debugf("already know about %s, no action", domain)
 		return nil
@@ -37,6 +37,11 @@ func (c *CommandRegistrar) Add(domain string) error {
 	return nil
 }
 
+// AddAll runs the add command for each domain in turn.
+func (c *CommandRegistrar) AddAll(owners map[string]Owner) map[string]error {
+	return addEach(c.Add, owners)
+}
+
 func (c *CommandRegistrar) Remove(domain string) error {
 	if !c.knownDomains.Has(domain) {
 		return nil
@@ -66,6 +71,49 @@ func (c *CommandRegistrar) RemoveAll() error {
 	return nil
 }
 
+func (c *CommandRegistrar) SetAddress(address string) error {
+	if address == c.address {
+		return nil
+	}
+
+	previous := c.address
+	c.address = address
+
+	errors := make([]string, 0)
+	for domain := range c.knownDomains {
+		if err := c.executeTemplate(c.addCommand, domain); err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+
+	if len(errors) > 0 {
+		// keep the previous address so that retrying re-applies every record
+		c.address = previous
+		return fmt.Errorf("one or more errors occurred: %s", strings.Join(errors, "\n"))
+	}
+
+	return nil
+}
+
+// Reconcile re-runs the add command for every known domain, as the state behind a custom
+// command cannot be inspected the command itself must be idempotent.
+func (c *CommandRegistrar) Reconcile() error {
+	errors := make([]string, 0)
+	for domain := range c.knownDomains {
+		// the current value behind a custom command is unknown, so it is logged as such
+		log.Infof("reconciling %s: re-applying add command, unknown -> %s", domain, c.address)
+		if err := c.executeTemplate(c.addCommand, domain); err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("one or more errors occurred: %s", strings.Join(errors, "\n"))
+	}
+
+	return nil
+}
+
 func (c *CommandRegistrar) executeTemplate(t *template.Template, domain string) error {
 	var buf bytes.Buffer
 	if err := t.Execute(&buf, map[string]string{"domain": domain, "address": c.address}); err != nil {
@@ -101,6 +149,10 @@ func NewCommandRegistrar(cfg *configuration.DNS) (*CommandRegistrar, error) {
 		return nil, errors.New("dns.custom not set in config")
 	}
 
+	if cfg.Ownership != nil && cfg.Ownership.Enabled {
+		return nil, errors.New("dns.ownership is not supported by dns.custom as existing records cannot be inspected")
+	}
+
 	var err error
 
 	c.addCommand, err = template.New("addCommand").Parse(cfg.Custom.AddCommand)
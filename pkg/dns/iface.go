@@ -1,7 +1,16 @@
 package dns
 
 type Registrar interface {
-	Add(string) error
+	// Add registers the domain on behalf of owner, refusing with an *OwnershipError when
+	// ownership records are enabled and the existing record belongs to someone else.
+	Add(string, Owner) error
+	// AddAll registers every domain on behalf of its owner, in as few requests as the provider allows,
+	// returning the error of each domain which could not be registered.
+	AddAll(map[string]Owner) map[string]error
 	Remove(string) error
 	RemoveAll() error
+	// SetAddress changes the advertised address, re-registering every known domain when it differs.
+	SetAddress(string) error
+	// Reconcile compares the records of every known domain with the provider and corrects any drift.
+	Reconcile() error
 }
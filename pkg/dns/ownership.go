@@ -0,0 +1,95 @@
+package dns
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	ownershipHeritage = "heritage=balanced"
+)
+
+// Owner identifies which load balancer and service a DNS record was created for.
+type Owner struct {
+	LoadBalancerId string
+	Namespace      string
+	Service        string
+}
+
+// String returns the value written to the ownership TXT record, e.g.
+// heritage=balanced,balanced/load-balancer-id=external,balanced/owner=default/web
+func (o Owner) String() string {
+	return fmt.Sprintf("%s,balanced/load-balancer-id=%s,balanced/owner=%s/%s", ownershipHeritage, o.LoadBalancerId, o.Namespace, o.Service)
+}
+
+func parseOwner(txt string) (Owner, bool) {
+	var o Owner
+
+	txt = strings.Trim(txt, `"`)
+	if !strings.HasPrefix(txt, ownershipHeritage+",") {
+		return o, false
+	}
+
+	for _, part := range strings.Split(txt, ",")[1:] {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "balanced/load-balancer-id":
+			o.LoadBalancerId = value
+		case "balanced/owner":
+			o.Namespace, o.Service, _ = strings.Cut(value, "/")
+		}
+	}
+
+	return o, true
+}
+
+// OwnershipError is returned when a registrar refuses to modify a record it does not own.
+type OwnershipError struct {
+	Domain string
+	Owner  Owner
+	reason string
+}
+
+func (e *OwnershipError) Error() string {
+	return fmt.Sprintf("refusing to modify dns record for %s: %s", e.Domain, e.reason)
+}
+
+// checkOwnership decides whether owner may modify the record for domain, given the TXT values
+// found at the ownership record name and whether the record itself already exists.
+func checkOwnership(domain string, owner Owner, txtValues []string, recordExists bool) error {
+	claimed, err := claimedBy(domain, owner, txtValues)
+	if err != nil {
+		return err
+	}
+
+	if recordExists && !claimed {
+		return &OwnershipError{Domain: domain, Owner: owner, reason: "record exists but has no balanced ownership TXT record"}
+	}
+
+	return nil
+}
+
+// claimedBy reports whether the TXT values mark owner as the owner of domain, returning an
+// *OwnershipError when any of them names somebody else.
+func claimedBy(domain string, owner Owner, txtValues []string) (bool, error) {
+	claimed := false
+
+	for _, txt := range txtValues {
+		current, ok := parseOwner(txt)
+		if !ok {
+			continue
+		}
+
+		if current != owner {
+			return false, &OwnershipError{Domain: domain, Owner: owner, reason: fmt.Sprintf("record is owned by %s/%s on load balancer %s", current.Namespace, current.Service, current.LoadBalancerId)}
+		}
+
+		claimed = true
+	}
+
+	return claimed, nil
+}
+
+func ownershipRecordName(prefix, domain string) string {
+	return prefix + domain
+}
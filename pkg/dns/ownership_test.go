@@ -0,0 +1,81 @@
+package dns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOwner_String(t *testing.T) {
+	o := Owner{LoadBalancerId: "external", Namespace: "default", Service: "web"}
+
+	assert.Equal(t, "heritage=balanced,balanced/load-balancer-id=external,balanced/owner=default/web", o.String())
+}
+
+func Test_parseOwner(t *testing.T) {
+	tests := map[string]struct {
+		txt           string
+		expectedOwner Owner
+		expectedOk    bool
+	}{
+		"parses quoted ownership record": {
+			`"heritage=balanced,balanced/load-balancer-id=external,balanced/owner=default/web"`,
+			Owner{LoadBalancerId: "external", Namespace: "default", Service: "web"},
+			true,
+		},
+		"ignores unrelated txt records": {
+			`"v=spf1 include:_spf.example.com ~all"`,
+			Owner{},
+			false,
+		},
+		"ignores records written by other tools": {
+			`"heritage=external-dns,external-dns/owner=default"`,
+			Owner{},
+			false,
+		},
+	}
+
+	for name, test := range tests {
+		owner, ok := parseOwner(test.txt)
+
+		assert.Equal(t, test.expectedOk, ok, name)
+		assert.Equal(t, test.expectedOwner, owner, name)
+	}
+}
+
+func Test_checkOwnership(t *testing.T) {
+	owner := Owner{LoadBalancerId: "external", Namespace: "default", Service: "web"}
+
+	tests := map[string]struct {
+		txtValues    []string
+		recordExists bool
+		expectedErr  error
+	}{
+		"allows new records": {
+			nil,
+			false,
+			nil,
+		},
+		"allows records owned by the same service": {
+			[]string{owner.String()},
+			true,
+			nil,
+		},
+		"refuses records without ownership": {
+			[]string{"v=spf1 ~all"},
+			true,
+			&OwnershipError{Domain: "foo.com", Owner: owner, reason: "record exists but has no balanced ownership TXT record"},
+		},
+		"refuses records owned by another load balancer": {
+			[]string{Owner{LoadBalancerId: "internal", Namespace: "default", Service: "web"}.String()},
+			true,
+			&OwnershipError{Domain: "foo.com", Owner: owner, reason: "record is owned by default/web on load balancer internal"},
+		},
+	}
+
+	for name, test := range tests {
+		err := checkOwnership("foo.com", owner, test.txtValues, test.recordExists)
+
+		assert.Equal(t, test.expectedErr, err, name)
+	}
+}
@@ -0,0 +1,34 @@
+package dns
+
+import "balanced/pkg/configuration"
+
+// NewRegistrar returns the Registrar matching the configured DNS provider, preferring
+// Route 53 when [cloud.aws] is set, then [dns.rfc2136] or [dns.cloudflare] and falling back to
+// the dns.custom commands.
+func NewRegistrar(cfg *configuration.Config) (Registrar, error) {
+	if cfg.Cloud.AWS != nil {
+		return NewRoute53Registrar(cfg.Cloud.AWS, &cfg.DNS)
+	}
+
+	if cfg.DNS.RFC2136 != nil {
+		return NewRFC2136Registrar(cfg.DNS.RFC2136, &cfg.DNS)
+	}
+
+	if cfg.DNS.Cloudflare != nil {
+		return NewCloudflareRegistrar(cfg.DNS.Cloudflare, &cfg.DNS)
+	}
+
+	return NewCommandRegistrar(&cfg.DNS)
+}
+
+// addEach registers every domain with add, for providers without a way to batch them.
+func addEach(add func(string, Owner) error, owners map[string]Owner) map[string]error {
+	errs := make(map[string]error)
+	for domain, owner := range owners {
+		if err := add(domain, owner); err != nil {
+			errs[domain] = err
+		}
+	}
+
+	return errs
+}
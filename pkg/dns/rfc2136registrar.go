@@ -0,0 +1,355 @@
+package dns
+
+import (
+	"balanced/pkg/configuration"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	mdns "github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// RFC2136Registrar registers domains by sending dynamic DNS UPDATE messages, optionally signed
+// with TSIG, to the primary server of a zone. Only this instance's own address is added or
+// removed so that several instances can contribute to the same record set.
+type RFC2136Registrar struct {
+	client        *mdns.Client
+	server        string
+	zone          string
+	ttl           uint32
+	tsigKeyName   string
+	tsigAlgorithm string
+	address       string
+	ownership     bool
+	txtPrefix     string
+	knownDomains  map[string]Owner
+}
+
+func (r *RFC2136Registrar) Add(domain string, owner Owner) error {
+	if current, known := r.knownDomains[domain]; known && current == owner {
+		log.Debugf("already know about %s, no action", domain)
+		return nil
+	}
+
+	if err := r.verifyOwnership(domain, owner); err != nil {
+		return err
+	}
+
+	m := r.newUpdate()
+	m.Insert(r.records(domain, owner))
+
+	if err := r.exchange(m); err != nil {
+		return err
+	}
+
+	r.knownDomains[domain] = owner
+
+	return nil
+}
+
+// AddAll registers each domain in turn, as Add checks ownership per domain.
+func (r *RFC2136Registrar) AddAll(owners map[string]Owner) map[string]error {
+	return addEach(r.Add, owners)
+}
+
+func (r *RFC2136Registrar) Remove(domain string) error {
+	owner, known := r.knownDomains[domain]
+	if !known {
+		return nil
+	}
+
+	if err := r.verifyOwnership(domain, owner); err != nil {
+		return err
+	}
+
+	m := r.newUpdate()
+	m.Remove(r.records(domain, owner))
+
+	if err := r.exchange(m); err != nil {
+		return err
+	}
+
+	delete(r.knownDomains, domain)
+
+	return nil
+}
+
+func (r *RFC2136Registrar) RemoveAll() error {
+	if len(r.knownDomains) == 0 {
+		return nil
+	}
+
+	m := r.newUpdate()
+	for domain, owner := range r.knownDomains {
+		m.Remove(r.records(domain, owner))
+	}
+
+	if err := r.exchange(m); err != nil {
+		return err
+	}
+
+	r.knownDomains = make(map[string]Owner)
+
+	return nil
+}
+
+func (r *RFC2136Registrar) SetAddress(address string) error {
+	if address == r.address {
+		return nil
+	}
+
+	if _, err := addressRecord("", address, r.ttl); err != nil {
+		return err
+	}
+
+	if len(r.knownDomains) > 0 {
+		m := r.newUpdate()
+		for domain := range r.knownDomains {
+			previous, _ := addressRecord(domain, r.address, r.ttl)
+			next, _ := addressRecord(domain, address, r.ttl)
+			m.Remove([]mdns.RR{previous})
+			m.Insert([]mdns.RR{next})
+		}
+
+		if err := r.exchange(m); err != nil {
+			return err
+		}
+	}
+
+	r.address = address
+
+	return nil
+}
+
+// Reconcile queries the server for the records of every known domain and re-inserts any that
+// are missing or carry a different ttl, sending all corrections in a single update.
+func (r *RFC2136Registrar) Reconcile() error {
+	m := r.newUpdate()
+	corrections := 0
+	errors := make([]string, 0)
+
+	for domain, owner := range r.knownDomains {
+		if r.ownership {
+			txtAnswers, err := r.query(ownershipRecordName(r.txtPrefix, domain), mdns.TypeTXT)
+			if err != nil {
+				errors = append(errors, err.Error())
+				continue
+			}
+
+			if _, err := claimedBy(domain, owner, txtStrings(txtAnswers)); err != nil {
+				errors = append(errors, err.Error())
+				continue
+			}
+		}
+
+		for _, desired := range r.records(domain, owner) {
+			answers, err := r.query(desired.Header().Name, desired.Header().Rrtype)
+			if err != nil {
+				errors = append(errors, err.Error())
+				continue
+			}
+
+			current := matchingRecord(answers, desired)
+			if current != nil && current.Header().Ttl == desired.Header().Ttl {
+				continue
+			}
+
+			before := "<missing>"
+			if current != nil {
+				before = current.String()
+				m.Remove([]mdns.RR{current})
+			}
+
+			log.Infof("correcting dns drift for %s: %s -> %s", domain, before, desired.String())
+			m.Insert([]mdns.RR{desired})
+			corrections++
+		}
+	}
+
+	if corrections > 0 {
+		if err := r.exchange(m); err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("one or more errors occurred: %s", strings.Join(errors, "\n"))
+	}
+
+	return nil
+}
+
+// records returns the address record for domain along with its ownership TXT record when enabled.
+func (r *RFC2136Registrar) records(domain string, owner Owner) []mdns.RR {
+	rr, _ := addressRecord(domain, r.address, r.ttl)
+	records := []mdns.RR{rr}
+
+	if r.ownership {
+		records = append(records, &mdns.TXT{
+			Hdr: mdns.RR_Header{Name: mdns.Fqdn(ownershipRecordName(r.txtPrefix, domain)), Rrtype: mdns.TypeTXT, Class: mdns.ClassINET, Ttl: r.ttl},
+			Txt: []string{owner.String()},
+		})
+	}
+
+	return records
+}
+
+func (r *RFC2136Registrar) verifyOwnership(domain string, owner Owner) error {
+	if !r.ownership {
+		return nil
+	}
+
+	txtAnswers, err := r.query(ownershipRecordName(r.txtPrefix, domain), mdns.TypeTXT)
+	if err != nil {
+		return err
+	}
+
+	txtValues := txtStrings(txtAnswers)
+
+	rr, _ := addressRecord(domain, r.address, r.ttl)
+	addressAnswers, err := r.query(domain, rr.Header().Rrtype)
+	if err != nil {
+		return err
+	}
+
+	return checkOwnership(domain, owner, txtValues, len(addressAnswers) > 0)
+}
+
+func (r *RFC2136Registrar) query(name string, rrtype uint16) ([]mdns.RR, error) {
+	m := new(mdns.Msg)
+	m.SetQuestion(mdns.Fqdn(name), rrtype)
+	m.RecursionDesired = false
+	r.sign(m)
+
+	resp, _, err := r.client.Exchange(m, r.server)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query %s for %s: %s", r.server, name, err)
+	}
+
+	switch resp.Rcode {
+	case mdns.RcodeSuccess, mdns.RcodeNameError:
+		return resp.Answer, nil
+	}
+
+	return nil, fmt.Errorf("query for %s failed: %s", name, mdns.RcodeToString[resp.Rcode])
+}
+
+func (r *RFC2136Registrar) newUpdate() *mdns.Msg {
+	m := new(mdns.Msg)
+	m.SetUpdate(r.zone)
+
+	return m
+}
+
+func (r *RFC2136Registrar) exchange(m *mdns.Msg) error {
+	r.sign(m)
+
+	resp, _, err := r.client.Exchange(m, r.server)
+	if err != nil {
+		return fmt.Errorf("unable to send dns update to %s: %s", r.server, err)
+	}
+
+	if resp.Rcode != mdns.RcodeSuccess {
+		return fmt.Errorf("dns update for zone %s rejected by %s: %s", r.zone, r.server, mdns.RcodeToString[resp.Rcode])
+	}
+
+	return nil
+}
+
+func (r *RFC2136Registrar) sign(m *mdns.Msg) {
+	if r.tsigKeyName != "" {
+		m.SetTsig(r.tsigKeyName, r.tsigAlgorithm, 300, time.Now().Unix())
+	}
+}
+
+func txtStrings(answers []mdns.RR) []string {
+	values := make([]string, 0)
+	for _, rr := range answers {
+		if txt, ok := rr.(*mdns.TXT); ok {
+			values = append(values, strings.Join(txt.Txt, ""))
+		}
+	}
+
+	return values
+}
+
+// matchingRecord returns the answer carrying the same data as want, regardless of its ttl.
+func matchingRecord(answers []mdns.RR, want mdns.RR) mdns.RR {
+	for _, rr := range answers {
+		if mdns.IsDuplicate(rr, want) {
+			return rr
+		}
+	}
+
+	return nil
+}
+
+// addressRecord returns an A or AAAA record for domain depending on the address family.
+func addressRecord(domain, address string, ttl uint32) (mdns.RR, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not a valid ip address", address)
+	}
+
+	hdr := mdns.RR_Header{Name: mdns.Fqdn(domain), Class: mdns.ClassINET, Ttl: ttl}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		hdr.Rrtype = mdns.TypeA
+		return &mdns.A{Hdr: hdr, A: ip4}, nil
+	}
+
+	hdr.Rrtype = mdns.TypeAAAA
+	return &mdns.AAAA{Hdr: hdr, AAAA: ip}, nil
+}
+
+func NewRFC2136Registrar(cfg *configuration.RFC2136, dnsCfg *configuration.DNS) (*RFC2136Registrar, error) {
+	if cfg.Server == "" {
+		return nil, errors.New("dns.rfc2136.server not set in config")
+	}
+
+	if cfg.Zone == "" {
+		return nil, errors.New("dns.rfc2136.zone not set in config")
+	}
+
+	if _, err := addressRecord("", dnsCfg.Address, cfg.TTL); err != nil {
+		return nil, fmt.Errorf("dns.advertised-address: %s", err)
+	}
+
+	server := cfg.Server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+
+	r := &RFC2136Registrar{
+		client:       &mdns.Client{},
+		server:       server,
+		zone:         mdns.Fqdn(cfg.Zone),
+		ttl:          cfg.TTL,
+		address:      dnsCfg.Address,
+		knownDomains: make(map[string]Owner),
+	}
+
+	if cfg.Timeout != nil {
+		r.client.Timeout = *cfg.Timeout
+	}
+
+	if cfg.TSIGKeyName != "" {
+		if cfg.TSIGSecret == "" {
+			return nil, errors.New("dns.rfc2136.tsig-secret not set in config")
+		}
+
+		r.tsigKeyName = mdns.Fqdn(cfg.TSIGKeyName)
+		r.tsigAlgorithm = mdns.Fqdn(cfg.TSIGAlgorithm)
+		r.client.TsigSecret = map[string]string{r.tsigKeyName: cfg.TSIGSecret}
+	}
+
+	if dnsCfg.Ownership != nil && dnsCfg.Ownership.Enabled {
+		r.ownership = true
+		r.txtPrefix = dnsCfg.Ownership.TXTPrefix
+	}
+
+	return r, nil
+}
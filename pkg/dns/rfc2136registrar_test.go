@@ -0,0 +1,285 @@
+package dns
+
+import (
+	"balanced/pkg/configuration"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+
+	mdns "github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testTSIGKey    = "balanced."
+	testTSIGSecret = "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"
+)
+
+// fakeZone is an in-process authoritative server which applies RFC 2136 updates to an in-memory zone.
+type fakeZone struct {
+	mx       sync.Mutex
+	records  map[string]mdns.RR
+	updates  int
+	unsigned int
+}
+
+func (z *fakeZone) ServeDNS(w mdns.ResponseWriter, req *mdns.Msg) {
+	z.mx.Lock()
+	defer z.mx.Unlock()
+
+	resp := new(mdns.Msg)
+	resp.SetReply(req)
+
+	if req.IsTsig() == nil || w.TsigStatus() != nil {
+		z.unsigned++
+		resp.Rcode = mdns.RcodeRefused
+		w.WriteMsg(resp)
+		return
+	}
+
+	switch req.Opcode {
+	case mdns.OpcodeUpdate:
+		z.updates++
+		for _, rr := range req.Ns {
+			switch rr.Header().Class {
+			case mdns.ClassNONE:
+				delete(z.records, fakeZoneKey(rr))
+			default:
+				z.records[fakeZoneKey(rr)] = rr
+			}
+		}
+	case mdns.OpcodeQuery:
+		q := req.Question[0]
+		for _, rr := range z.records {
+			if rr.Header().Name == q.Name && rr.Header().Rrtype == q.Qtype {
+				resp.Answer = append(resp.Answer, rr)
+			}
+		}
+	}
+
+	resp.SetTsig(testTSIGKey, mdns.HmacSHA256, 300, int64(req.IsTsig().TimeSigned))
+	w.WriteMsg(resp)
+}
+
+// fakeZoneKey identifies a record by name, type and data, ignoring the class and ttl which differ in deletions.
+func fakeZoneKey(rr mdns.RR) string {
+	cp := mdns.Copy(rr)
+	cp.Header().Class = mdns.ClassINET
+	cp.Header().Ttl = 0
+
+	return cp.String()
+}
+
+func (z *fakeZone) values() []string {
+	z.mx.Lock()
+	defer z.mx.Unlock()
+
+	values := make([]string, 0, len(z.records))
+	for _, rr := range z.records {
+		values = append(values, rr.String())
+	}
+	sort.Strings(values)
+
+	return values
+}
+
+func (z *fakeZone) updateCount() int {
+	z.mx.Lock()
+	defer z.mx.Unlock()
+
+	return z.updates
+}
+
+func (z *fakeZone) unsignedCount() int {
+	z.mx.Lock()
+	defer z.mx.Unlock()
+
+	return z.unsigned
+}
+
+func newFakeZone(t *testing.T) (*fakeZone, string) {
+	zone := &fakeZone{records: make(map[string]mdns.RR)}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	srv := &mdns.Server{
+		PacketConn:        pc,
+		Handler:           zone,
+		TsigSecret:        map[string]string{testTSIGKey: testTSIGSecret},
+		NotifyStartedFunc: func() { close(started) },
+		// the default accept func answers UPDATE messages with NOTIMP
+		MsgAcceptFunc: func(mdns.Header) mdns.MsgAcceptAction { return mdns.MsgAccept },
+	}
+
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+
+	return zone, pc.LocalAddr().String()
+}
+
+func newTestRFC2136Registrar(t *testing.T, server, address string) *RFC2136Registrar {
+	r, err := NewRFC2136Registrar(&configuration.RFC2136{
+		Server:        server,
+		Zone:          "example.com",
+		TTL:           30,
+		TSIGKeyName:   "balanced",
+		TSIGSecret:    testTSIGSecret,
+		TSIGAlgorithm: "hmac-sha256",
+	}, &configuration.DNS{Address: address})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+func TestNewRFC2136Registrar(t *testing.T) {
+	tests := map[string]struct {
+		cfg            *configuration.RFC2136
+		dnsCfg         *configuration.DNS
+		expectedErr    string
+		expectedServer string
+	}{
+		"returns error when server is not set": {
+			&configuration.RFC2136{Zone: "example.com"},
+			&configuration.DNS{Address: "192.0.2.10"},
+			"dns.rfc2136.server not set in config",
+			"",
+		},
+		"returns error when zone is not set": {
+			&configuration.RFC2136{Server: "ns1.example.com"},
+			&configuration.DNS{Address: "192.0.2.10"},
+			"dns.rfc2136.zone not set in config",
+			"",
+		},
+		"returns error when advertised address is invalid": {
+			&configuration.RFC2136{Server: "ns1.example.com", Zone: "example.com"},
+			&configuration.DNS{Address: "x.x.x.x"},
+			"dns.advertised-address: \"x.x.x.x\" is not a valid ip address",
+			"",
+		},
+		"returns error when tsig key has no secret": {
+			&configuration.RFC2136{Server: "ns1.example.com", Zone: "example.com", TSIGKeyName: "balanced"},
+			&configuration.DNS{Address: "192.0.2.10"},
+			"dns.rfc2136.tsig-secret not set in config",
+			"",
+		},
+		"defaults server port to 53": {
+			&configuration.RFC2136{Server: "ns1.example.com", Zone: "example.com"},
+			&configuration.DNS{Address: "192.0.2.10"},
+			"",
+			"ns1.example.com:53",
+		},
+	}
+
+	for name, test := range tests {
+		r, err := NewRFC2136Registrar(test.cfg, test.dnsCfg)
+
+		if test.expectedErr != "" {
+			assert.EqualError(t, err, test.expectedErr, name)
+		} else {
+			assert.NoError(t, err, name)
+			assert.Equal(t, test.expectedServer, r.server, name)
+		}
+	}
+}
+
+func TestRFC2136Registrar_AddAndRemove(t *testing.T) {
+	zone, server := newFakeZone(t)
+	v4 := newTestRFC2136Registrar(t, server, "192.0.2.10")
+	v6 := newTestRFC2136Registrar(t, server, "2001:db8::10")
+
+	assert.NoError(t, v4.Add("foo.example.com", testOwner))
+	assert.NoError(t, v4.Add("foo.example.com", testOwner))
+	assert.NoError(t, v6.Add("foo.example.com", testOwner))
+
+	assert.Equal(t, 2, zone.updateCount(), "known domains should not be re-submitted")
+	assert.Equal(t, []string{
+		"foo.example.com.\t30\tIN\tA\t192.0.2.10",
+		"foo.example.com.\t30\tIN\tAAAA\t2001:db8::10",
+	}, zone.values())
+
+	assert.NoError(t, v4.Remove("foo.example.com"))
+
+	assert.Equal(t, []string{"foo.example.com.\t30\tIN\tAAAA\t2001:db8::10"}, zone.values(), "only this instance's address should be removed")
+	assert.Equal(t, 0, zone.unsignedCount())
+}
+
+func TestRFC2136Registrar_RemoveAll(t *testing.T) {
+	zone, server := newFakeZone(t)
+	r := newTestRFC2136Registrar(t, server, "192.0.2.10")
+
+	assert.NoError(t, r.RemoveAll())
+	assert.Equal(t, 0, zone.updateCount(), "nothing should be sent when no domains are known")
+
+	assert.NoError(t, r.Add("foo.example.com", testOwner))
+	assert.NoError(t, r.Add("bar.example.com", testOwner))
+	assert.NoError(t, r.RemoveAll())
+
+	assert.Equal(t, 3, zone.updateCount(), "all removals should be sent in one update")
+	assert.Empty(t, zone.values())
+}
+
+func TestRFC2136Registrar_SetAddress(t *testing.T) {
+	zone, server := newFakeZone(t)
+	r := newTestRFC2136Registrar(t, server, "192.0.2.10")
+
+	assert.NoError(t, r.Add("foo.example.com", testOwner))
+	assert.NoError(t, r.SetAddress("192.0.2.20"))
+
+	assert.Equal(t, []string{"foo.example.com.\t30\tIN\tA\t192.0.2.20"}, zone.values())
+	assert.EqualError(t, r.SetAddress("nope"), "\"nope\" is not a valid ip address")
+}
+
+func TestRFC2136Registrar_Reconcile(t *testing.T) {
+	zone, server := newFakeZone(t)
+	r := newTestRFC2136Registrar(t, server, "192.0.2.10")
+
+	assert.NoError(t, r.Add("foo.example.com", testOwner))
+	assert.NoError(t, r.Reconcile())
+	assert.Equal(t, 1, zone.updateCount(), "nothing should be sent when records are in sync")
+
+	zone.mx.Lock()
+	zone.records = make(map[string]mdns.RR)
+	zone.mx.Unlock()
+
+	assert.NoError(t, r.Reconcile())
+	assert.Equal(t, 2, zone.updateCount())
+	assert.Equal(t, []string{"foo.example.com.\t30\tIN\tA\t192.0.2.10"}, zone.values())
+}
+
+func TestRFC2136Registrar_rejectsUnsignedUpdates(t *testing.T) {
+	zone, server := newFakeZone(t)
+	r := newTestRFC2136Registrar(t, server, "192.0.2.10")
+	r.tsigKeyName = ""
+
+	err := r.Add("foo.example.com", testOwner)
+
+	assert.EqualError(t, err, "dns update for zone example.com. rejected by "+server+": REFUSED")
+	assert.Equal(t, 1, zone.unsignedCount())
+	assert.NotContains(t, r.knownDomains, "foo.example.com")
+}
+
+func TestRFC2136Registrar_ownership(t *testing.T) {
+	zone, server := newFakeZone(t)
+	r := newTestRFC2136Registrar(t, server, "192.0.2.10")
+	r.ownership = true
+
+	other := newTestRFC2136Registrar(t, server, "192.0.2.11")
+	other.ownership = true
+
+	assert.NoError(t, r.Add("foo.example.com", testOwner))
+	assert.Contains(t, zone.values(), "foo.example.com.\t30\tIN\tTXT\t\"heritage=balanced,balanced/load-balancer-id=external,balanced/owner=default/web\"")
+
+	err := other.Add("foo.example.com", Owner{LoadBalancerId: "external", Namespace: "other", Service: "api"})
+
+	var ownershipErr *OwnershipError
+	assert.ErrorAs(t, err, &ownershipErr)
+	assert.Len(t, zone.values(), 2, "foreign record should not be modified")
+}
@@ -0,0 +1,519 @@
+package dns
+
+import (
+	"balanced/pkg/configuration"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	route53WaitDelay   = time.Second * 5
+	route53WaitTimeout = time.Minute * 5
+
+	route53RoutingPolicySimple     = "simple"
+	route53RoutingPolicyMultiValue = "multivalue"
+	route53RoutingPolicyWeighted   = "weighted"
+)
+
+// Route53Registrar manages one record per domain in a Route 53 hosted zone. When a multivalue
+// or weighted routing policy is configured each balanced instance owns its own answer, identified
+// by its set identifier, so several instances can advertise the same domain side by side.
+type Route53Registrar struct {
+	client        route53iface.Route53API
+	address       string
+	hostedZoneId  string
+	recordType    string
+	ttl           int64
+	routingPolicy string
+	setIdentifier string
+	weight        int64
+	healthCheckId string
+	ownership     bool
+	txtPrefix     string
+	waitTimeout   time.Duration
+	waitDelay     time.Duration
+	knownDomains  map[string]Owner
+
+	// changes being waited on to become INSYNC
+	syncing sync.WaitGroup
+}
+
+func (r *Route53Registrar) Add(domain string, owner Owner) error {
+	if current, known := r.knownDomains[domain]; known && current == owner {
+		log.Debugf("already know about %s, no action", domain)
+		return nil
+	}
+
+	if err := r.verifyOwnership(domain, owner); err != nil {
+		return err
+	}
+
+	if err := r.apply(r.changes(route53.ChangeActionUpsert, domain, owner)...); err != nil {
+		return err
+	}
+
+	r.knownDomains[domain] = owner
+
+	return nil
+}
+
+// AddAll registers every domain not yet known with a single batch, after checking ownership of each.
+func (r *Route53Registrar) AddAll(owners map[string]Owner) map[string]error {
+	errs := make(map[string]error)
+	changes := make([]*route53.Change, 0, len(owners))
+	added := make([]string, 0, len(owners))
+
+	for domain, owner := range owners {
+		if current, known := r.knownDomains[domain]; known && current == owner {
+			continue
+		}
+
+		if err := r.verifyOwnership(domain, owner); err != nil {
+			errs[domain] = err
+			continue
+		}
+
+		changes = append(changes, r.changes(route53.ChangeActionUpsert, domain, owner)...)
+		added = append(added, domain)
+	}
+
+	if err := r.apply(changes...); err != nil {
+		for _, domain := range added {
+			errs[domain] = err
+		}
+		return errs
+	}
+
+	for _, domain := range added {
+		r.knownDomains[domain] = owners[domain]
+	}
+
+	return errs
+}
+
+func (r *Route53Registrar) Remove(domain string) error {
+	owner, known := r.knownDomains[domain]
+	if !known {
+		return nil
+	}
+
+	if err := r.verifyOwnership(domain, owner); err != nil {
+		return err
+	}
+
+	if err := r.apply(r.changes(route53.ChangeActionDelete, domain, owner)...); err != nil {
+		return err
+	}
+
+	delete(r.knownDomains, domain)
+
+	return nil
+}
+
+func (r *Route53Registrar) RemoveAll() error {
+	changes := make([]*route53.Change, 0, len(r.knownDomains))
+	for domain, owner := range r.knownDomains {
+		changes = append(changes, r.changes(route53.ChangeActionDelete, domain, owner)...)
+	}
+
+	if err := r.apply(changes...); err != nil {
+		return err
+	}
+
+	r.knownDomains = make(map[string]Owner)
+
+	return nil
+}
+
+func (r *Route53Registrar) SetAddress(address string) error {
+	if address == r.address {
+		return nil
+	}
+
+	changes := make([]*route53.Change, 0, len(r.knownDomains))
+	for domain := range r.knownDomains {
+		changes = append(changes, r.change(route53.ChangeActionUpsert, r.recordSet(domain, r.recordType, address)))
+	}
+
+	// the address is only taken on once the records point at it, so that a failed change can be retried
+	if err := r.apply(changes...); err != nil {
+		return err
+	}
+
+	r.address = address
+
+	return nil
+}
+
+func (r *Route53Registrar) Reconcile() error {
+	changes := make([]*route53.Change, 0)
+	errors := make([]string, 0)
+
+	for domain, owner := range r.knownDomains {
+		actual, err := r.recordSetsNamed(domain)
+		if err != nil {
+			errors = append(errors, err.Error())
+			continue
+		}
+
+		if txtName := ownershipRecordName(r.txtPrefix, domain); r.ownership && txtName != domain {
+			txtRecords, err := r.recordSetsNamed(txtName)
+			if err != nil {
+				errors = append(errors, err.Error())
+				continue
+			}
+			actual = append(actual, txtRecords...)
+		}
+
+		if r.ownership {
+			// a missing ownership record is restored, but a record claimed by someone else is left alone
+			if _, err := claimedBy(domain, owner, txtValuesOf(actual, ownershipRecordName(r.txtPrefix, domain))); err != nil {
+				errors = append(errors, err.Error())
+				continue
+			}
+		}
+
+		for _, desired := range r.changes(route53.ChangeActionUpsert, domain, owner) {
+			current := findRecordSet(actual, desired.ResourceRecordSet)
+			if recordSetsEqual(current, desired.ResourceRecordSet) {
+				continue
+			}
+
+			log.Infof("correcting route 53 drift for %s %s: %s -> %s", aws.StringValue(desired.ResourceRecordSet.Name), aws.StringValue(desired.ResourceRecordSet.Type), describeRecordSet(current), describeRecordSet(desired.ResourceRecordSet))
+			changes = append(changes, desired)
+		}
+	}
+
+	if err := r.apply(changes...); err != nil {
+		errors = append(errors, err.Error())
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("one or more errors occurred: %s", strings.Join(errors, "\n"))
+	}
+
+	return nil
+}
+
+// changes returns the address record change for domain along with its ownership TXT record when enabled.
+func (r *Route53Registrar) changes(action, domain string, owner Owner) []*route53.Change {
+	changes := []*route53.Change{
+		r.change(action, r.recordSet(domain, r.recordType, r.address)),
+	}
+
+	if r.ownership {
+		txt := r.recordSet(ownershipRecordName(r.txtPrefix, domain), route53.RRTypeTxt, fmt.Sprintf("%q", owner.String()))
+		changes = append(changes, r.change(action, txt))
+	}
+
+	return changes
+}
+
+func (r *Route53Registrar) change(action string, rrs *route53.ResourceRecordSet) *route53.Change {
+	return &route53.Change{
+		Action:            aws.String(action),
+		ResourceRecordSet: rrs,
+	}
+}
+
+func (r *Route53Registrar) recordSet(name, recordType, value string) *route53.ResourceRecordSet {
+	rrs := &route53.ResourceRecordSet{
+		Name: aws.String(name),
+		Type: aws.String(recordType),
+		TTL:  aws.Int64(r.ttl),
+		ResourceRecords: []*route53.ResourceRecord{
+			{Value: aws.String(value)},
+		},
+	}
+
+	switch r.routingPolicy {
+	case route53RoutingPolicyMultiValue:
+		rrs.SetIdentifier = aws.String(r.setIdentifier)
+		rrs.MultiValueAnswer = aws.Bool(true)
+	case route53RoutingPolicyWeighted:
+		rrs.SetIdentifier = aws.String(r.setIdentifier)
+		rrs.Weight = aws.Int64(r.weight)
+	}
+
+	// the health check only applies to the address record, ownership records must always resolve
+	if r.healthCheckId != "" && recordType == r.recordType {
+		rrs.HealthCheckId = aws.String(r.healthCheckId)
+	}
+
+	return rrs
+}
+
+func (r *Route53Registrar) verifyOwnership(domain string, owner Owner) error {
+	if !r.ownership {
+		return nil
+	}
+
+	records, err := r.recordSetsNamed(domain)
+	if err != nil {
+		return err
+	}
+
+	txtName := ownershipRecordName(r.txtPrefix, domain)
+	if txtName != domain {
+		txtRecords, err := r.recordSetsNamed(txtName)
+		if err != nil {
+			return err
+		}
+		records = append(records, txtRecords...)
+	}
+
+	recordExists := false
+	for _, rrs := range records {
+		if aws.StringValue(rrs.Name) == domain && aws.StringValue(rrs.Type) == r.recordType {
+			recordExists = true
+		}
+	}
+
+	txtValues := txtValuesOf(records, txtName)
+
+	return checkOwnership(domain, owner, txtValues, recordExists)
+}
+
+// recordSetsNamed returns every record set in the hosted zone with exactly the given name, any trailing dot is removed.
+func (r *Route53Registrar) recordSetsNamed(name string) ([]*route53.ResourceRecordSet, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.waitTimeout)
+	defer cancel()
+
+	records := make([]*route53.ResourceRecordSet, 0)
+
+	err := r.client.ListResourceRecordSetsPagesWithContext(ctx, &route53.ListResourceRecordSetsInput{
+		HostedZoneId:    aws.String(r.hostedZoneId),
+		StartRecordName: aws.String(name),
+	}, func(out *route53.ListResourceRecordSetsOutput, lastPage bool) bool {
+		for _, rrs := range out.ResourceRecordSets {
+			rrs.Name = aws.String(strings.TrimSuffix(aws.StringValue(rrs.Name), "."))
+			if aws.StringValue(rrs.Name) != name {
+				// record sets are sorted by name, nothing further can match
+				return false
+			}
+			records = append(records, rrs)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list route 53 record sets for %s: %s", name, err)
+	}
+
+	return records, nil
+}
+
+// apply submits all changes as a single batch. Route 53 only takes a while to propagate accepted
+// changes, so waiting for them to become INSYNC happens in the background and is merely logged.
+func (r *Route53Registrar) apply(changes ...*route53.Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.waitTimeout)
+	defer cancel()
+
+	out, err := r.client.ChangeResourceRecordSetsWithContext(ctx, &route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(r.hostedZoneId),
+		ChangeBatch: &route53.ChangeBatch{
+			Comment: aws.String("managed by balanced"),
+			Changes: changes,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to change route 53 record sets: %s", err)
+	}
+
+	log.Debugf("route 53 change %s submitted, waiting for it to be applied", aws.StringValue(out.ChangeInfo.Id))
+
+	r.syncing.Add(1)
+	go func() {
+		defer r.syncing.Done()
+		r.waitForSync(out.ChangeInfo.Id)
+	}()
+
+	return nil
+}
+
+func (r *Route53Registrar) waitForSync(id *string) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.waitTimeout)
+	defer cancel()
+
+	if err := r.client.WaitUntilResourceRecordSetsChangedWithContext(
+		ctx,
+		&route53.GetChangeInput{Id: id},
+		request.WithWaiterDelay(request.ConstantWaiterDelay(r.waitDelay)),
+		request.WithWaiterMaxAttempts(int(r.waitTimeout/r.waitDelay)+1),
+	); err != nil {
+		log.Warnf("route 53 change %s did not complete: %s", aws.StringValue(id), err)
+		return
+	}
+
+	log.Debugf("route 53 change %s is INSYNC", aws.StringValue(id))
+}
+
+func (r *Route53Registrar) setRoutingDefaults() error {
+	switch r.routingPolicy {
+	case "", route53RoutingPolicySimple:
+		r.routingPolicy = route53RoutingPolicySimple
+		return nil
+	case route53RoutingPolicyMultiValue, route53RoutingPolicyWeighted:
+	default:
+		return fmt.Errorf("cloud.aws.route-53-routing-policy %q is not supported, expected one of: simple, multivalue, weighted", r.routingPolicy)
+	}
+
+	// each instance needs a stable identifier so it only ever touches its own answer
+	if r.setIdentifier == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("cloud.aws.route-53-set-identifier not set and hostname could not be determined: %s", err)
+		}
+		r.setIdentifier = hostname
+	}
+
+	return nil
+}
+
+func txtValuesOf(records []*route53.ResourceRecordSet, name string) []string {
+	values := make([]string, 0)
+	for _, rrs := range records {
+		if aws.StringValue(rrs.Name) != name || aws.StringValue(rrs.Type) != route53.RRTypeTxt {
+			continue
+		}
+
+		for _, rr := range rrs.ResourceRecords {
+			values = append(values, aws.StringValue(rr.Value))
+		}
+	}
+
+	return values
+}
+
+// findRecordSet returns the record set matching the name, type and set identifier of want.
+func findRecordSet(records []*route53.ResourceRecordSet, want *route53.ResourceRecordSet) *route53.ResourceRecordSet {
+	for _, rrs := range records {
+		if aws.StringValue(rrs.Name) == aws.StringValue(want.Name) &&
+			aws.StringValue(rrs.Type) == aws.StringValue(want.Type) &&
+			aws.StringValue(rrs.SetIdentifier) == aws.StringValue(want.SetIdentifier) {
+			return rrs
+		}
+	}
+
+	return nil
+}
+
+func recordSetsEqual(a, b *route53.ResourceRecordSet) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return describeRecordSet(a) == describeRecordSet(b)
+}
+
+func describeRecordSet(rrs *route53.ResourceRecordSet) string {
+	if rrs == nil {
+		return "<missing>"
+	}
+
+	values := make([]string, 0, len(rrs.ResourceRecords))
+	for _, rr := range rrs.ResourceRecords {
+		values = append(values, aws.StringValue(rr.Value))
+	}
+	sort.Strings(values)
+
+	desc := fmt.Sprintf("%s ttl=%d", strings.Join(values, ","), aws.Int64Value(rrs.TTL))
+	if rrs.Weight != nil {
+		desc += fmt.Sprintf(" weight=%d", aws.Int64Value(rrs.Weight))
+	}
+	if aws.BoolValue(rrs.MultiValueAnswer) {
+		desc += " multivalue"
+	}
+	if rrs.HealthCheckId != nil {
+		desc += " health-check=" + aws.StringValue(rrs.HealthCheckId)
+	}
+
+	return desc
+}
+
+func newRoute53Client(cfg *configuration.AWS) (route53iface.Route53API, error) {
+	awsCfg := aws.NewConfig()
+
+	if cfg.Region != "" {
+		awsCfg = awsCfg.WithRegion(cfg.Region)
+	}
+
+	if cfg.Endpoint != "" {
+		awsCfg = awsCfg.WithEndpoint(cfg.Endpoint)
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *awsCfg,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create aws session: %s", err)
+	}
+
+	return route53.New(sess), nil
+}
+
+func NewRoute53Registrar(cfg *configuration.AWS, dnsCfg *configuration.DNS) (*Route53Registrar, error) {
+	if cfg.HostedZoneId == "" {
+		return nil, errors.New("cloud.aws.route-53-hosted-zone-id not set in config")
+	}
+
+	if dnsCfg.Address == "" {
+		return nil, errors.New("dns.advertised-address not set in config")
+	}
+
+	client, err := newRoute53Client(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Route53Registrar{
+		client:        client,
+		address:       dnsCfg.Address,
+		hostedZoneId:  cfg.HostedZoneId,
+		recordType:    cfg.Type,
+		ttl:           cfg.TTL,
+		routingPolicy: cfg.RoutingPolicy,
+		setIdentifier: cfg.SetIdentifier,
+		weight:        1,
+		healthCheckId: cfg.HealthCheckId,
+		waitTimeout:   route53WaitTimeout,
+		waitDelay:     route53WaitDelay,
+		knownDomains:  make(map[string]Owner),
+	}
+
+	if dnsCfg.Ownership != nil && dnsCfg.Ownership.Enabled {
+		r.ownership = true
+		r.txtPrefix = dnsCfg.Ownership.TXTPrefix
+	}
+
+	if cfg.WaitTimeout != nil {
+		r.waitTimeout = *cfg.WaitTimeout
+	}
+
+	if cfg.Weight != nil {
+		r.weight = *cfg.Weight
+	}
+
+	if err := r.setRoutingDefaults(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
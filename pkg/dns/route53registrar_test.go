@@ -0,0 +1,501 @@
+package dns
+
+import (
+	"balanced/pkg/configuration"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeRoute53Record struct {
+	Name             string   `xml:"Name"`
+	Type             string   `xml:"Type"`
+	SetIdentifier    string   `xml:"SetIdentifier,omitempty"`
+	MultiValueAnswer bool     `xml:"MultiValueAnswer,omitempty"`
+	Weight           int64    `xml:"Weight,omitempty"`
+	TTL              int64    `xml:"TTL"`
+	Values           []string `xml:"ResourceRecords>ResourceRecord>Value"`
+	HealthCheckId    string   `xml:"HealthCheckId,omitempty"`
+}
+
+func (r *fakeRoute53Record) key() string {
+	return fmt.Sprintf("%s|%s|%s", strings.TrimSuffix(r.Name, "."), r.Type, r.SetIdentifier)
+}
+
+type fakeRoute53Change struct {
+	Action string            `xml:"Action"`
+	Record fakeRoute53Record `xml:"ResourceRecordSet"`
+}
+
+type fakeRoute53Request struct {
+	Changes []fakeRoute53Change `xml:"ChangeBatch>Changes>Change"`
+}
+
+// fakeRoute53 is a minimal stand-in for the Route 53 REST API which keeps record sets in memory.
+type fakeRoute53 struct {
+	mx       sync.Mutex
+	records  map[string]*fakeRoute53Record
+	batches  []fakeRoute53Request
+	polls    int
+	failWith int
+}
+
+func (f *fakeRoute53) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/rrset/"):
+		f.changeResourceRecordSets(w, r)
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/rrset"):
+		f.listResourceRecordSets(w, r)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/2013-04-01/change/"):
+		f.getChange(w)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeRoute53) changeResourceRecordSets(w http.ResponseWriter, r *http.Request) {
+	if f.failWith != 0 {
+		w.WriteHeader(f.failWith)
+		fmt.Fprint(w, `<ErrorResponse><Error><Code>InvalidChangeBatch</Code><Message>boom</Message></Error></ErrorResponse>`)
+		return
+	}
+
+	var req fakeRoute53Request
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.batches = append(f.batches, req)
+
+	for i := range req.Changes {
+		rec := req.Changes[i].Record
+		switch req.Changes[i].Action {
+		case "DELETE":
+			delete(f.records, rec.key())
+		default:
+			f.records[rec.key()] = &rec
+		}
+	}
+
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<ChangeResourceRecordSetsResponse xmlns="https://route53.amazonaws.com/doc/2013-04-01/"><ChangeInfo><Id>/change/C%d</Id><Status>PENDING</Status><SubmittedAt>2022-10-01T00:00:00Z</SubmittedAt></ChangeInfo></ChangeResourceRecordSetsResponse>`, len(f.batches))
+}
+
+func (f *fakeRoute53) listResourceRecordSets(w http.ResponseWriter, r *http.Request) {
+	start := r.URL.Query().Get("name")
+
+	keys := make([]string, 0, len(f.records))
+	for k := range f.records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	resp := struct {
+		XMLName     xml.Name             `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ListResourceRecordSetsResponse"`
+		Records     []*fakeRoute53Record `xml:"ResourceRecordSets>ResourceRecordSet"`
+		IsTruncated bool                 `xml:"IsTruncated"`
+		MaxItems    string               `xml:"MaxItems"`
+	}{MaxItems: "100"}
+
+	for _, k := range keys {
+		rec := f.records[k]
+		if strings.TrimSuffix(rec.Name, ".") < strings.TrimSuffix(start, ".") {
+			continue
+		}
+
+		// route 53 always returns fully qualified names
+		returned := *rec
+		returned.Name = strings.TrimSuffix(rec.Name, ".") + "."
+		resp.Records = append(resp.Records, &returned)
+	}
+
+	xml.NewEncoder(w).Encode(resp)
+}
+
+func (f *fakeRoute53) getChange(w http.ResponseWriter) {
+	f.polls++
+
+	// report the change as pending on the first poll so the waiter has to retry
+	status := "INSYNC"
+	if f.polls%2 == 1 {
+		status = "PENDING"
+	}
+
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<GetChangeResponse xmlns="https://route53.amazonaws.com/doc/2013-04-01/"><ChangeInfo><Id>/change/C%d</Id><Status>%s</Status><SubmittedAt>2022-10-01T00:00:00Z</SubmittedAt></ChangeInfo></GetChangeResponse>`, len(f.batches), status)
+}
+
+var testOwner = Owner{LoadBalancerId: "external", Namespace: "default", Service: "web"}
+
+func newFakeRoute53() *fakeRoute53 {
+	return &fakeRoute53{records: make(map[string]*fakeRoute53Record)}
+}
+
+func newTestRoute53Registrar(t *testing.T, fake *fakeRoute53, cfg *configuration.AWS, address string) *Route53Registrar {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	// a CA bundle makes every new session rewrite http.DefaultClient, which changes still being waited on use
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	cfg.Region = "us-east-1"
+	cfg.Endpoint = srv.URL
+
+	r, err := NewRoute53Registrar(cfg, &configuration.DNS{Address: address})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.waitDelay = time.Millisecond
+
+	// changes are waited on in the background, which must not outlive the fake server
+	t.Cleanup(r.syncing.Wait)
+
+	return r
+}
+
+func TestNewRoute53Registrar(t *testing.T) {
+	tests := map[string]struct {
+		cfg         *configuration.AWS
+		dnsCfg      *configuration.DNS
+		expectedErr string
+	}{
+		"returns error when hosted zone is not set": {
+			&configuration.AWS{},
+			&configuration.DNS{Address: "192.0.2.10"},
+			"cloud.aws.route-53-hosted-zone-id not set in config",
+		},
+		"returns error when advertised address is not set": {
+			&configuration.AWS{HostedZoneId: "Z123"},
+			&configuration.DNS{},
+			"dns.advertised-address not set in config",
+		},
+		"returns error when routing policy is not supported": {
+			&configuration.AWS{HostedZoneId: "Z123", Region: "eu-west-1", RoutingPolicy: "latency"},
+			&configuration.DNS{Address: "192.0.2.10"},
+			"cloud.aws.route-53-routing-policy \"latency\" is not supported, expected one of: simple, multivalue, weighted",
+		},
+		"returns registrar when config is valid": {
+			&configuration.AWS{HostedZoneId: "Z123", Region: "eu-west-1"},
+			&configuration.DNS{Address: "192.0.2.10"},
+			"",
+		},
+	}
+
+	for name, test := range tests {
+		r, err := NewRoute53Registrar(test.cfg, test.dnsCfg)
+
+		if test.expectedErr != "" {
+			assert.EqualError(t, err, test.expectedErr, name)
+			assert.Nil(t, r, name)
+		} else {
+			assert.NoError(t, err, name)
+			assert.Equal(t, route53WaitTimeout, r.waitTimeout, name)
+		}
+	}
+}
+
+func TestRoute53Registrar_Add(t *testing.T) {
+	fake := newFakeRoute53()
+	r := newTestRoute53Registrar(t, fake, &configuration.AWS{HostedZoneId: "Z123", Type: "A", TTL: 30}, "192.0.2.10")
+
+	assert.NoError(t, r.Add("foo.example.com", testOwner))
+	assert.NoError(t, r.Add("foo.example.com", testOwner))
+
+	assert.Len(t, fake.batches, 1, "known domains should not be re-submitted")
+	assert.Equal(t, "UPSERT", fake.batches[0].Changes[0].Action)
+	assert.Equal(t, &fakeRoute53Record{Name: "foo.example.com", Type: "A", TTL: 30, Values: []string{"192.0.2.10"}}, fake.records["foo.example.com|A|"])
+	r.syncing.Wait()
+	assert.Equal(t, 2, fake.polls, "registrar should wait for the change to be INSYNC in the background")
+	assert.Contains(t, r.knownDomains, "foo.example.com")
+}
+
+func TestRoute53Registrar_AddAll(t *testing.T) {
+	fake := newFakeRoute53()
+	r := newTestRoute53Registrar(t, fake, &configuration.AWS{HostedZoneId: "Z123", Type: "A", TTL: 30}, "192.0.2.10")
+
+	assert.NoError(t, r.Add("foo.example.com", testOwner))
+
+	errs := r.AddAll(map[string]Owner{"foo.example.com": testOwner, "bar.example.com": testOwner, "baz.example.com": testOwner})
+
+	assert.Empty(t, errs)
+	assert.Len(t, fake.batches, 2)
+	assert.Len(t, fake.batches[1].Changes, 2, "every unknown domain should be sent in one batch")
+	assert.Contains(t, r.knownDomains, "bar.example.com")
+	assert.Contains(t, r.knownDomains, "baz.example.com")
+
+	fake.failWith = http.StatusBadRequest
+
+	errs = r.AddAll(map[string]Owner{"qux.example.com": testOwner})
+
+	assert.ErrorContains(t, errs["qux.example.com"], "InvalidChangeBatch: boom")
+	assert.NotContains(t, r.knownDomains, "qux.example.com")
+	r.syncing.Wait()
+}
+
+func TestRoute53Registrar_AddReturnsApiError(t *testing.T) {
+	fake := newFakeRoute53()
+	r := newTestRoute53Registrar(t, fake, &configuration.AWS{HostedZoneId: "Z123", Type: "A", TTL: 30}, "192.0.2.10")
+	fake.failWith = http.StatusBadRequest
+
+	err := r.Add("foo.example.com", testOwner)
+
+	assert.ErrorContains(t, err, "unable to change route 53 record sets: InvalidChangeBatch: boom")
+	assert.NotContains(t, r.knownDomains, "foo.example.com")
+}
+
+func TestRoute53Registrar_Remove(t *testing.T) {
+	fake := newFakeRoute53()
+	r := newTestRoute53Registrar(t, fake, &configuration.AWS{HostedZoneId: "Z123", Type: "A", TTL: 30}, "192.0.2.10")
+
+	assert.NoError(t, r.Remove("unknown.example.com"))
+	assert.Len(t, fake.batches, 0, "unknown domains should not be removed")
+
+	assert.NoError(t, r.Add("foo.example.com", testOwner))
+	assert.NoError(t, r.Remove("foo.example.com"))
+
+	assert.Len(t, fake.batches, 2)
+	assert.Equal(t, "DELETE", fake.batches[1].Changes[0].Action)
+	assert.Empty(t, fake.records)
+	assert.NotContains(t, r.knownDomains, "foo.example.com")
+}
+
+func TestRoute53Registrar_RemoveAll(t *testing.T) {
+	fake := newFakeRoute53()
+	r := newTestRoute53Registrar(t, fake, &configuration.AWS{HostedZoneId: "Z123", Type: "A", TTL: 30}, "192.0.2.10")
+
+	assert.NoError(t, r.RemoveAll())
+	assert.Len(t, fake.batches, 0, "nothing should be submitted when no domains are known")
+
+	assert.NoError(t, r.Add("foo.example.com", testOwner))
+	assert.NoError(t, r.Add("bar.example.com", testOwner))
+	assert.NoError(t, r.RemoveAll())
+
+	assert.Len(t, fake.batches, 3)
+	assert.Len(t, fake.batches[2].Changes, 2, "all deletions should be sent in one batch")
+	assert.Empty(t, fake.records)
+	assert.Equal(t, make(map[string]Owner), r.knownDomains)
+}
+
+func TestNewRoute53Registrar_routingDefaults(t *testing.T) {
+	hostname, _ := os.Hostname()
+
+	tests := map[string]struct {
+		cfg                   *configuration.AWS
+		expectedPolicy        string
+		expectedSetIdentifier string
+		expectedWeight        int64
+	}{
+		"defaults to simple routing": {
+			&configuration.AWS{HostedZoneId: "Z123", Region: "eu-west-1"},
+			"simple",
+			"",
+			1,
+		},
+		"uses hostname as set identifier when not configured": {
+			&configuration.AWS{HostedZoneId: "Z123", Region: "eu-west-1", RoutingPolicy: "multivalue"},
+			"multivalue",
+			hostname,
+			1,
+		},
+		"uses configured set identifier and weight": {
+			&configuration.AWS{HostedZoneId: "Z123", Region: "eu-west-1", RoutingPolicy: "weighted", SetIdentifier: "lb-a", Weight: aws.Int64(0)},
+			"weighted",
+			"lb-a",
+			0,
+		},
+	}
+
+	for name, test := range tests {
+		r, err := NewRoute53Registrar(test.cfg, &configuration.DNS{Address: "192.0.2.10"})
+
+		assert.NoError(t, err, name)
+		assert.Equal(t, test.expectedPolicy, r.routingPolicy, name)
+		assert.Equal(t, test.expectedSetIdentifier, r.setIdentifier, name)
+		assert.Equal(t, test.expectedWeight, r.weight, name)
+	}
+}
+
+func TestRoute53Registrar_recordSet(t *testing.T) {
+	tests := map[string]struct {
+		cfg      *configuration.AWS
+		expected *fakeRoute53Record
+	}{
+		"multivalue answer with health check": {
+			&configuration.AWS{HostedZoneId: "Z123", Type: "A", TTL: 30, RoutingPolicy: "multivalue", SetIdentifier: "lb-a", HealthCheckId: "hc-1"},
+			&fakeRoute53Record{Name: "foo.example.com", Type: "A", TTL: 30, SetIdentifier: "lb-a", MultiValueAnswer: true, HealthCheckId: "hc-1", Values: []string{"192.0.2.10"}},
+		},
+		"weighted answer": {
+			&configuration.AWS{HostedZoneId: "Z123", Type: "A", TTL: 30, RoutingPolicy: "weighted", SetIdentifier: "lb-a", Weight: aws.Int64(10)},
+			&fakeRoute53Record{Name: "foo.example.com", Type: "A", TTL: 30, SetIdentifier: "lb-a", Weight: 10, Values: []string{"192.0.2.10"}},
+		},
+	}
+
+	for name, test := range tests {
+		fake := newFakeRoute53()
+		r := newTestRoute53Registrar(t, fake, test.cfg, "192.0.2.10")
+
+		assert.NoError(t, r.Add("foo.example.com", testOwner), name)
+		assert.Equal(t, test.expected, fake.records["foo.example.com|A|lb-a"], name)
+	}
+}
+
+func TestRoute53Registrar_sharedDomainAcrossInstances(t *testing.T) {
+	fake := newFakeRoute53()
+	a := newTestRoute53Registrar(t, fake, &configuration.AWS{HostedZoneId: "Z123", Type: "A", TTL: 30, RoutingPolicy: "multivalue", SetIdentifier: "lb-a"}, "192.0.2.10")
+	b := newTestRoute53Registrar(t, fake, &configuration.AWS{HostedZoneId: "Z123", Type: "A", TTL: 30, RoutingPolicy: "multivalue", SetIdentifier: "lb-b"}, "192.0.2.11")
+
+	assert.NoError(t, a.Add("foo.example.com", testOwner))
+	assert.NoError(t, b.Add("foo.example.com", testOwner))
+	assert.Len(t, fake.records, 2, "each instance should own its own answer")
+
+	assert.NoError(t, a.RemoveAll())
+
+	assert.Len(t, fake.records, 1)
+	assert.Equal(t, []string{"192.0.2.11"}, fake.records["foo.example.com|A|lb-b"].Values, "removing one instance should leave the other's answer")
+}
+
+func TestRoute53Registrar_SetAddress(t *testing.T) {
+	fake := newFakeRoute53()
+	r := newTestRoute53Registrar(t, fake, &configuration.AWS{HostedZoneId: "Z123", Type: "A", TTL: 30}, "192.0.2.10")
+
+	assert.NoError(t, r.Add("foo.example.com", testOwner))
+	assert.NoError(t, r.Add("bar.example.com", testOwner))
+
+	assert.NoError(t, r.SetAddress("192.0.2.10"))
+	assert.Len(t, fake.batches, 2, "unchanged address should not re-register domains")
+
+	assert.NoError(t, r.SetAddress("192.0.2.20"))
+	assert.Len(t, fake.batches, 3)
+	assert.Len(t, fake.batches[2].Changes, 2, "all known domains should be re-registered in one batch")
+	assert.Equal(t, []string{"192.0.2.20"}, fake.records["foo.example.com|A|"].Values)
+	assert.Equal(t, []string{"192.0.2.20"}, fake.records["bar.example.com|A|"].Values)
+}
+
+func TestRoute53Registrar_Reconcile(t *testing.T) {
+	fake := newFakeRoute53()
+	r := newTestRoute53Registrar(t, fake, &configuration.AWS{HostedZoneId: "Z123", Type: "A", TTL: 30}, "192.0.2.10")
+
+	assert.NoError(t, r.Add("foo.example.com", testOwner))
+	assert.NoError(t, r.Add("bar.example.com", testOwner))
+
+	assert.NoError(t, r.Reconcile())
+	assert.Len(t, fake.batches, 2, "nothing should be sent when records are in sync")
+
+	delete(fake.records, "foo.example.com|A|")
+	fake.records["bar.example.com|A|"].Values = []string{"192.0.2.99"}
+
+	assert.NoError(t, r.Reconcile())
+	assert.Len(t, fake.batches, 3)
+	assert.Len(t, fake.batches[2].Changes, 2, "all corrections should be sent in one batch")
+	assert.Equal(t, []string{"192.0.2.10"}, fake.records["foo.example.com|A|"].Values)
+	assert.Equal(t, []string{"192.0.2.10"}, fake.records["bar.example.com|A|"].Values)
+}
+
+func TestRoute53Registrar_ReconcileLeavesForeignRecords(t *testing.T) {
+	fake := newFakeRoute53()
+	r := newTestRoute53Registrar(t, fake, &configuration.AWS{HostedZoneId: "Z123", Type: "A", TTL: 30}, "192.0.2.10")
+	r.ownership = true
+
+	assert.NoError(t, r.Add("foo.example.com", testOwner))
+
+	other := Owner{LoadBalancerId: "external", Namespace: "other", Service: "api"}
+	fake.records["foo.example.com|TXT|"].Values = []string{fmt.Sprintf("%q", other.String())}
+	fake.records["foo.example.com|A|"].Values = []string{"192.0.2.11"}
+
+	assert.ErrorContains(t, r.Reconcile(), "record is owned by other/api on load balancer external")
+	assert.Len(t, fake.batches, 1)
+	assert.Equal(t, []string{"192.0.2.11"}, fake.records["foo.example.com|A|"].Values)
+}
+
+func TestRoute53Registrar_ownership(t *testing.T) {
+	foreign := Owner{LoadBalancerId: "external", Namespace: "other", Service: "api"}
+
+	tests := map[string]struct {
+		existing      []*fakeRoute53Record
+		expectedErr   string
+		expectedTotal int
+	}{
+		"creates record and ownership txt when domain is unused": {
+			nil,
+			"",
+			2,
+		},
+		"updates record already owned by this service": {
+			[]*fakeRoute53Record{
+				{Name: "foo.example.com", Type: "A", TTL: 30, Values: []string{"192.0.2.99"}},
+				{Name: "foo.example.com", Type: "TXT", TTL: 30, Values: []string{fmt.Sprintf("%q", testOwner.String())}},
+			},
+			"",
+			2,
+		},
+		"refuses record without ownership txt": {
+			[]*fakeRoute53Record{
+				{Name: "foo.example.com", Type: "A", TTL: 30, Values: []string{"192.0.2.99"}},
+			},
+			"refusing to modify dns record for foo.example.com: record exists but has no balanced ownership TXT record",
+			1,
+		},
+		"refuses record owned by another service": {
+			[]*fakeRoute53Record{
+				{Name: "foo.example.com", Type: "A", TTL: 30, Values: []string{"192.0.2.99"}},
+				{Name: "foo.example.com", Type: "TXT", TTL: 30, Values: []string{fmt.Sprintf("%q", foreign.String())}},
+			},
+			"refusing to modify dns record for foo.example.com: record is owned by other/api on load balancer external",
+			2,
+		},
+	}
+
+	for name, test := range tests {
+		fake := newFakeRoute53()
+		for _, rec := range test.existing {
+			fake.records[rec.key()] = rec
+		}
+
+		r := newTestRoute53Registrar(t, fake, &configuration.AWS{HostedZoneId: "Z123", Type: "A", TTL: 30}, "192.0.2.10")
+		r.ownership = true
+
+		err := r.Add("foo.example.com", testOwner)
+
+		if test.expectedErr != "" {
+			var ownershipErr *OwnershipError
+			assert.ErrorAs(t, err, &ownershipErr, name)
+			assert.EqualError(t, err, test.expectedErr, name)
+			assert.Equal(t, []string{"192.0.2.99"}, fake.records["foo.example.com|A|"].Values, name)
+		} else {
+			assert.NoError(t, err, name)
+			assert.Equal(t, []string{"192.0.2.10"}, fake.records["foo.example.com|A|"].Values, name)
+			assert.Equal(t, []string{fmt.Sprintf("%q", testOwner.String())}, fake.records["foo.example.com|TXT|"].Values, name)
+		}
+		assert.Len(t, fake.records, test.expectedTotal, name)
+	}
+}
+
+func TestRoute53Registrar_ownershipRemovesTxt(t *testing.T) {
+	fake := newFakeRoute53()
+	r := newTestRoute53Registrar(t, fake, &configuration.AWS{HostedZoneId: "Z123", Type: "A", TTL: 30}, "192.0.2.10")
+	r.ownership = true
+	r.txtPrefix = "_balanced."
+
+	assert.NoError(t, r.Add("foo.example.com", testOwner))
+	assert.Contains(t, fake.records, "_balanced.foo.example.com|TXT|")
+
+	assert.NoError(t, r.Remove("foo.example.com"))
+	assert.Empty(t, fake.records)
+}
@@ -0,0 +1,97 @@
+package k8s
+
+import (
+	"balanced/pkg/queue"
+	"balanced/pkg/types"
+
+	log "github.com/sirupsen/logrus"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+func (w *Watcher) setupEndpointSlices(kubeInformerFactory kubeinformers.SharedInformerFactory, changes *queue.Queue) {
+	sliceInformer := kubeInformerFactory.Discovery().V1().EndpointSlices().Informer()
+
+	sliceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			slice := obj.(*discoveryv1.EndpointSlice)
+			if !shouldWatchResource(w, slice) {
+				log.Debugf("endpoint slice added but namespace %s is not being watched", slice.GetNamespace())
+				return
+			}
+
+			if service := slice.Labels[discoveryv1.LabelServiceName]; service != "" {
+				w.handleSliceChange(changes, slice.Namespace, service, w.slicesForService(slice.Namespace, service))
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			w.handleSliceUpdate(changes, oldObj.(*discoveryv1.EndpointSlice), newObj.(*discoveryv1.EndpointSlice))
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+
+			if slice, ok := obj.(*discoveryv1.EndpointSlice); ok {
+				w.handleSliceUpdate(changes, slice, nil)
+			}
+		},
+	})
+}
+
+// handleSliceUpdate compares the addresses of every slice of the service before and after a slice
+// changed or was deleted, only queuing changes when the merged set of addresses differs.
+func (w *Watcher) handleSliceUpdate(changes *queue.Queue, oldSlice, newSlice *discoveryv1.EndpointSlice) {
+	if !shouldWatchResource(w, oldSlice) {
+		log.Debugf("endpoint slice changed but namespace %s is not being watched", oldSlice.GetNamespace())
+		return
+	}
+
+	service := oldSlice.Labels[discoveryv1.LabelServiceName]
+	if service == "" {
+		return
+	}
+
+	current := w.slicesForService(oldSlice.Namespace, service)
+
+	previous := []*discoveryv1.EndpointSlice{oldSlice}
+	for _, slice := range current {
+		if slice.Name != oldSlice.Name {
+			previous = append(previous, slice)
+		}
+	}
+
+	if endpointSlicesHaveChanged(previous, current) {
+		w.handleSliceChange(changes, oldSlice.Namespace, service, current)
+	}
+}
+
+func (w *Watcher) handleSliceChange(changes *queue.Queue, namespace, service string, slices []*discoveryv1.EndpointSlice) {
+	w.queueChanges(changes, &namespaceNameKey{name: service, namespace: namespace}, func(domain, healthCheck string) *types.Change {
+		return types.NewLoadBalancerDefinitionChangeFromSlices(domain, healthCheck, namespace, service, slices)
+	})
+}
+
+// slicesForService returns every slice the informer currently knows for the service.
+func (w *Watcher) slicesForService(namespace, service string) []*discoveryv1.EndpointSlice {
+	slices := make([]*discoveryv1.EndpointSlice, 0)
+	if w.endpointSlices == nil {
+		return slices
+	}
+
+	objs, err := w.endpointSlices.ByIndex(cache.NamespaceIndex, namespace)
+	if err != nil {
+		log.Errorf("unable to list endpoint slices in %s: %s", namespace, err)
+		return slices
+	}
+
+	for _, obj := range objs {
+		slice, ok := obj.(*discoveryv1.EndpointSlice)
+		if ok && slice.Labels[discoveryv1.LabelServiceName] == service {
+			slices = append(slices, slice)
+		}
+	}
+
+	return slices
+}
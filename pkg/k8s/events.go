@@ -0,0 +1,16 @@
+package k8s
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// EventRecorder returns a recorder which publishes events to the cluster the watcher is connected to.
+func (w *Watcher) EventRecorder() record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: w.clientset.CoreV1().Events("")})
+
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "balanced"})
+}
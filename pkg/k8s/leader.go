@@ -0,0 +1,87 @@
+package k8s
+
+import (
+	"balanced/pkg/configuration"
+	"context"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// RunLeaderElection campaigns for the configured Lease until stop is closed, reporting on the returned
+// channel whenever this instance gains or loses leadership. An instance which loses the lease falls
+// back to standby and campaigns again. The second channel is closed once the election has ended after
+// stop was closed, by which time a held lease has been released.
+func (w *Watcher) RunLeaderElection(cfg *configuration.LeaderElection, stop <-chan struct{}) (<-chan bool, <-chan struct{}, error) {
+	leading := make(chan bool)
+	released := make(chan struct{})
+
+	notify := func(isLeader bool) {
+		select {
+		case leading <- isLeader:
+		case <-stop:
+		}
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: cfg.LeaseName, Namespace: cfg.LeaseNamespace},
+		Client:     w.clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: cfg.Identity},
+	}
+
+	electionCfg := leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   *cfg.LeaseDuration,
+		RenewDeadline:   *cfg.RenewDeadline,
+		RetryPeriod:     *cfg.RetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            cfg.LeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				log.Infof("%s acquired lease %s/%s, managing DNS records", cfg.Identity, cfg.LeaseNamespace, cfg.LeaseName)
+				notify(true)
+			},
+			OnStoppedLeading: func() {
+				log.Infof("%s is not holding lease %s/%s, standing by", cfg.Identity, cfg.LeaseNamespace, cfg.LeaseName)
+				notify(false)
+			},
+			OnNewLeader: func(identity string) {
+				if identity != cfg.Identity {
+					log.Infof("%s is leading, standing by", identity)
+				}
+			},
+		},
+	}
+
+	elector, err := leaderelection.NewLeaderElector(electionCfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("kubernetes.leader-election: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	go func() {
+		defer close(released)
+		defer close(leading)
+
+		for {
+			elector.Run(ctx)
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			// campaign again with a fresh elector so nothing observed during the lost term carries over
+			elector, _ = leaderelection.NewLeaderElector(electionCfg)
+		}
+	}()
+
+	return leading, released, nil
+}
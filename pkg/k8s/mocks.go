@@ -1,45 +1,25 @@
 package k8s
 
 import (
-	"context"
-	"errors"
-
 	v1 "k8s.io/api/core/v1"
-	"k8s.io/client-go/kubernetes"
-	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
-
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
 )
 
-type mockClientset struct {
-	services []*v1.Service
-	kubernetes.Interface
-}
-
-func (cs *mockClientset) CoreV1() typedcorev1.CoreV1Interface {
-	return &mockCoreV1{services: cs.services}
-}
-
-type mockCoreV1 struct {
-	services []*v1.Service
-	typedcorev1.CoreV1Interface
-}
-
-func (c *mockCoreV1) Services(string) typedcorev1.ServiceInterface {
-	return &mockServices{services: c.services}
-}
+func newMockServiceLister(services ...*v1.Service) corev1listers.ServiceLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, svc := range services {
+		indexer.Add(svc)
+	}
 
-type mockServices struct {
-	services []*v1.Service
-	typedcorev1.ServiceInterface
+	return corev1listers.NewServiceLister(indexer)
 }
 
-func (s *mockServices) Get(ctx context.Context, name string, opts metav1.GetOptions) (*v1.Service, error) {
-	for _, svc := range s.services {
-		if svc.Name == name {
-			return svc, nil
-		}
+func newMockPodLister(pods ...*v1.Pod) corev1listers.PodLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, pod := range pods {
+		indexer.Add(pod)
 	}
 
-	return nil, errors.New("does not exist")
+	return corev1listers.NewPodLister(indexer)
 }
@@ -0,0 +1,176 @@
+package k8s
+
+import (
+	"balanced/pkg/queue"
+	"balanced/pkg/types"
+	"reflect"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+// the range of weights HAProxy accepts for a server
+const maxServerWeight = 256
+
+// podOptions are the weight and backup flag annotated on the pod behind a server.
+type podOptions struct {
+	weight *int
+	backup bool
+}
+
+// podLookup returns the options of the pod an endpoint address targets.
+type podLookup func(namespace string, ref *corev1.ObjectReference) podOptions
+
+func (w *Watcher) setupPods(changes *queue.Queue) {
+	podInformer := w.informer.Core().V1().Pods().Informer()
+
+	// endpoints are unchanged when only a pod's annotations are, so those updates are followed separately
+	podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldPod := oldObj.(*corev1.Pod)
+			newPod := newObj.(*corev1.Pod)
+
+			if !shouldWatchResource(w, newPod) || reflect.DeepEqual(w.optionsOf(oldPod), w.optionsOf(newPod)) {
+				return
+			}
+
+			log.Infof("weight or backup annotation of pod %s changed", namespacedResourceToKey(newPod))
+			w.handlePodChange(changes, oldPod)
+		},
+	})
+}
+
+// handlePodChange queues changes for the services whose endpoints target the pod, comparing them
+// with the pod's options before the update.
+func (w *Watcher) handlePodChange(changes *queue.Queue, oldPod *corev1.Pod) {
+	previous := func(namespace string, ref *corev1.ObjectReference) podOptions {
+		if namespace == oldPod.Namespace && ref.Name == oldPod.Name {
+			return w.optionsOf(oldPod)
+		}
+		return w.currentPodOptions(namespace, ref)
+	}
+
+	if w.endpointSlices != nil {
+		services := make(types.Set[string])
+		objs, err := w.endpointSlices.ByIndex(cache.NamespaceIndex, oldPod.Namespace)
+		if err != nil {
+			log.Errorf("unable to list endpoint slices in %s: %s", oldPod.Namespace, err)
+			return
+		}
+
+		for _, obj := range objs {
+			if slice, ok := obj.(*discoveryv1.EndpointSlice); ok && sliceTargetsPod(slice, oldPod) {
+				services.Add(slice.Labels[discoveryv1.LabelServiceName])
+			}
+		}
+
+		for service := range services {
+			if service != "" {
+				w.handleSliceChange(changes, oldPod.Namespace, service, w.slicesForService(oldPod.Namespace, service))
+			}
+		}
+		return
+	}
+
+	if w.endpoints == nil {
+		return
+	}
+
+	endpoints, err := w.endpoints.Endpoints(oldPod.Namespace).List(labels.Everything())
+	if err != nil {
+		log.Errorf("unable to list endpoints in %s: %s", oldPod.Namespace, err)
+		return
+	}
+
+	for _, e := range endpoints {
+		if endpointHasChanged(e, e, previous, w.currentPodOptions) {
+			w.handleChange(changes, e)
+		}
+	}
+}
+
+func sliceTargetsPod(slice *discoveryv1.EndpointSlice, pod *corev1.Pod) bool {
+	for _, ep := range slice.Endpoints {
+		if ep.TargetRef != nil && ep.TargetRef.Kind == "Pod" && ep.TargetRef.Name == pod.Name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// currentPodOptions looks up the pod ref targets in the informer's cache.
+func (w *Watcher) currentPodOptions(namespace string, ref *corev1.ObjectReference) podOptions {
+	if w.pods == nil || ref == nil || ref.Kind != "Pod" {
+		return podOptions{}
+	}
+
+	if ref.Namespace != "" {
+		namespace = ref.Namespace
+	}
+
+	pod, err := w.pods.Pods(namespace).Get(ref.Name)
+	if err != nil {
+		log.Debugf("unable to find pod %s/%s: %s", namespace, ref.Name, err)
+		return podOptions{}
+	}
+
+	return w.optionsOf(pod)
+}
+
+// optionsOf reads the weight and backup annotations of a pod, ignoring invalid values.
+func (w *Watcher) optionsOf(pod *corev1.Pod) podOptions {
+	opts := podOptions{}
+	annotations := pod.GetAnnotations()
+
+	if value, exists := annotations[w.cfg.WeightAnnotationKey()]; exists {
+		weight, err := strconv.Atoi(value)
+		if err != nil || weight < 0 || weight > maxServerWeight {
+			log.Warnf("pod %s: ignoring %s %q, expected a number between 0 and %d", namespacedResourceToKey(pod), w.cfg.WeightAnnotationKey(), value, maxServerWeight)
+		} else {
+			opts.weight = &weight
+		}
+	}
+
+	if value, exists := annotations[w.cfg.BackupAnnotationKey()]; exists {
+		backup, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Warnf("pod %s: ignoring %s %q, expected true or false", namespacedResourceToKey(pod), w.cfg.BackupAnnotationKey(), value)
+		} else {
+			opts.backup = backup
+		}
+	}
+
+	return opts
+}
+
+// applyPodOptions sets the weight and backup flag of every server from the pod its address targets.
+func (w *Watcher) applyPodOptions(def *types.LoadBalancerUpstreamDefinition) {
+	for _, srv := range def.Servers {
+		opts := w.currentPodOptions(def.Namespace, srv.TargetRef)
+		srv.Weight = opts.weight
+		srv.Backup = opts.backup
+	}
+}
+
+// addressOptions returns the options of the pod behind each address of an endpoint, keyed by address.
+func addressOptions(e *corev1.Endpoints, pods podLookup) map[string]podOptions {
+	opts := make(map[string]podOptions)
+	if pods == nil {
+		return opts
+	}
+
+	for _, ss := range e.Subsets {
+		for _, a := range ss.Addresses {
+			if a.TargetRef != nil {
+				opts[a.IP] = pods(e.Namespace, a.TargetRef)
+			}
+		}
+	}
+
+	return opts
+}
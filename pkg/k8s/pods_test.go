@@ -0,0 +1,101 @@
+package k8s
+
+import (
+	"balanced/pkg/configuration"
+	"balanced/pkg/types"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newPod(name string, annotations map[string]string) *corev1.Pod {
+	return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations}}
+}
+
+func TestWatcher_optionsOf(t *testing.T) {
+	w := &Watcher{cfg: &configuration.KubeConfig{ServiceAnnotationKeyPrefix: "my.uri"}}
+	weight := func(w int) *int { return &w }
+
+	tests := map[string]struct {
+		annotations map[string]string
+		expected    podOptions
+	}{
+		"no annotations":     {nil, podOptions{}},
+		"weight and backup":  {map[string]string{"my.uri/weight": "10", "my.uri/backup": "true"}, podOptions{weight: weight(10), backup: true}},
+		"zero weight":        {map[string]string{"my.uri/weight": "0"}, podOptions{weight: weight(0)}},
+		"weight too large":   {map[string]string{"my.uri/weight": "257"}, podOptions{}},
+		"weight not numeric": {map[string]string{"my.uri/weight": "heavy"}, podOptions{}},
+		"backup not boolean": {map[string]string{"my.uri/backup": "maybe"}, podOptions{}},
+		"other prefix":       {map[string]string{"other.uri/weight": "10"}, podOptions{}},
+	}
+
+	for name, test := range tests {
+		assert.Equal(t, test.expected, w.optionsOf(newPod("web-1", test.annotations)), name)
+	}
+}
+
+func TestWatcher_applyPodOptions(t *testing.T) {
+	w := &Watcher{
+		cfg:  &configuration.KubeConfig{ServiceAnnotationKeyPrefix: "my.uri"},
+		pods: newMockPodLister(newPod("web-1", map[string]string{"my.uri/weight": "10"}), newPod("web-2", map[string]string{"my.uri/backup": "true"})),
+	}
+
+	pod := func(name string) *corev1.ObjectReference {
+		return &corev1.ObjectReference{Kind: "Pod", Namespace: "default", Name: name}
+	}
+
+	def := &types.LoadBalancerUpstreamDefinition{
+		Domain:    "hi.com",
+		Namespace: "default",
+		Servers: []*types.Server{
+			{Id: "web-1", TargetRef: pod("web-1")},
+			// the pod is found through the TargetRef whatever the server is named
+			{Id: "10.1.1.2", TargetRef: pod("web-2")},
+			{Id: "web-3", TargetRef: pod("web-3")},
+			{Id: "10.1.1.4"},
+		},
+	}
+
+	w.applyPodOptions(def)
+
+	ten := 10
+	assert.Equal(t, []*types.Server{
+		{Id: "web-1", TargetRef: pod("web-1"), Weight: &ten},
+		{Id: "10.1.1.2", TargetRef: pod("web-2"), Backup: true},
+		{Id: "web-3", TargetRef: pod("web-3")},
+		{Id: "10.1.1.4"},
+	}, def.Servers)
+}
+
+func Test_endpointHasChangedPodOptions(t *testing.T) {
+	ten, twenty := 10, 20
+	endpoint := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", ResourceVersion: "a"},
+		Subsets: []corev1.EndpointSubset{
+			{Addresses: []corev1.EndpointAddress{
+				{IP: "10.1.1.1", TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "web-1"}},
+			}},
+		},
+	}
+
+	lookup := func(opts podOptions) podLookup {
+		return func(string, *corev1.ObjectReference) podOptions { return opts }
+	}
+
+	tests := map[string]struct {
+		oldPods  podLookup
+		newPods  podLookup
+		expected bool
+	}{
+		"has not changed if options match": {lookup(podOptions{weight: &ten}), lookup(podOptions{weight: &ten}), false},
+		"has changed if weight changed":    {lookup(podOptions{weight: &ten}), lookup(podOptions{weight: &twenty}), true},
+		"has changed if weight was added":  {lookup(podOptions{}), lookup(podOptions{weight: &ten}), true},
+		"has changed if backup changed":    {lookup(podOptions{}), lookup(podOptions{backup: true}), true},
+	}
+
+	for name, test := range tests {
+		assert.Equal(t, test.expected, endpointHasChanged(endpoint, endpoint, test.oldPods, test.newPods), name)
+	}
+}
@@ -11,13 +11,12 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
 )
 
 type serviceCache struct {
 	cfg           *configuration.KubeConfig
-	clientset     kubernetes.Interface
+	services      corev1listers.ServiceLister
 	domainMapping map[string]*serviceData
 	mx            *sync.RWMutex
 }
@@ -25,44 +24,71 @@ type serviceCache struct {
 type serviceData struct {
 	domains             []string
 	healthCheckEndpoint string
+	template            string
+	labels              map[string]string
+	annotations         map[string]string
 }
 
 func (s *serviceCache) lookupService(ctx context.Context, ns *namespaceNameKey) *serviceData {
 	s.mx.RLock()
-	defer s.mx.RUnlock()
-	if _, exists := s.domainMapping[ns.String()]; !exists {
-		svc, err := s.getService(ctx, ns)
-		if err != nil {
+	d, exists := s.domainMapping[ns.String()]
+	s.mx.RUnlock()
+
+	if exists {
+		return d
+	}
+
+	svc, err := s.getService(ctx, ns)
+	if err != nil {
+		log.Error(err.Error())
+		return nil
+	}
+
+	domains, err := s.getDomainFromServiceAnnotation(svc, ns)
+	if err != nil {
+		var ign *IgnoreService
+		if errors.As(err, &ign) {
+			log.Warn(err)
+		} else {
+			log.Errorf("%T", err)
 			log.Error(err.Error())
-			return nil
 		}
+		return nil
+	}
 
-		domains, err := s.getDomainFromServiceAnnotation(svc, ns)
-		if err != nil {
-			var ign *IgnoreService
-			if errors.As(err, &ign) {
-				log.Warn(err)
-			} else {
-				log.Errorf("%T", err)
-				log.Error(err.Error())
-			}
-			return nil
-		}
+	if len(domains) == 0 {
+		return nil
+	}
+
+	d = &serviceData{
+		domains:             domains,
+		healthCheckEndpoint: s.tryGetHealthCheckEndpointFromServiceAnnotation(svc, ns),
+		template:            svc.GetAnnotations()[s.cfg.TemplateAnnotationKey()],
+		labels:              make(map[string]string, len(svc.GetLabels())),
+		annotations:         make(map[string]string),
+	}
+
+	for k, v := range svc.GetLabels() {
+		d.labels[k] = v
+	}
 
-		if len(domains) > 0 {
-			d := &serviceData{
-				domains:             domains,
-				healthCheckEndpoint: s.tryGetHealthCheckEndpointFromServiceAnnotation(svc, ns),
-			}
-			s.domainMapping[ns.String()] = d
+	prefix := s.cfg.AnnotationKeyPrefix()
+	for k, v := range svc.GetAnnotations() {
+		if strings.HasPrefix(k, prefix) {
+			d.annotations[strings.TrimPrefix(k, prefix)] = v
 		}
 	}
 
-	return s.domainMapping[ns.String()]
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.domainMapping[ns.String()] = d
+
+	return d
 }
 
+// getService reads the service from the shared informer's cache rather than the API server.
 func (s *serviceCache) getService(ctx context.Context, ns *namespaceNameKey) (*corev1.Service, error) {
-	svc, err := s.clientset.CoreV1().Services(ns.namespace).Get(ctx, ns.name, metav1.GetOptions{})
+	svc, err := s.services.Services(ns.namespace).Get(ns.name)
 	if err != nil {
 		return nil, fmt.Errorf("error retrieving service %s => %s", ns, err.Error())
 	}
@@ -108,10 +134,10 @@ func (s *serviceCache) removeServiceRecord(ctx context.Context, ns *namespaceNam
 	delete(s.domainMapping, ns.String())
 }
 
-func newServiceCache(cfg *configuration.KubeConfig, clientset kubernetes.Interface) *serviceCache {
+func newServiceCache(cfg *configuration.KubeConfig, services corev1listers.ServiceLister) *serviceCache {
 	return &serviceCache{
 		cfg:           cfg,
-		clientset:     clientset,
+		services:      services,
 		domainMapping: make(map[string]*serviceData),
 		mx:            &sync.RWMutex{},
 	}
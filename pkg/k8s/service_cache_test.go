@@ -10,7 +10,6 @@ import (
 	"github.com/stretchr/testify/assert"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
 )
 
 func TestServiceCache_getDomainFromServiceAnnotation(t *testing.T) {
@@ -71,7 +70,7 @@ func TestServiceCache_getDomainFromServiceAnnotation(t *testing.T) {
 				ServiceAnnotationKeyPrefix:      "my.uri",
 				ServiceAnnotationLoadBalancerId: "testing",
 			},
-			clientset: &mockClientset{services: []*v1.Service{test.service}},
+			services: newMockServiceLister(test.service),
 		}
 
 		domains, err := s.getDomainFromServiceAnnotation(test.service, test.namespaceKey)
@@ -83,19 +82,19 @@ func TestServiceCache_getDomainFromServiceAnnotation(t *testing.T) {
 
 func TestServiceCache_getService(t *testing.T) {
 	tests := map[string]struct {
-		clientset       kubernetes.Interface
+		services        []*v1.Service
 		namespaceKey    *namespaceNameKey
 		expectedService *v1.Service
 		expectedErr     error
 	}{
 		"returns error if service cannot be found": {
-			&mockClientset{},
+			nil,
 			&namespaceNameKey{name: "foo", namespace: "bar"},
 			nil,
-			errors.New("error retrieving service foo:bar => does not exist"),
+			errors.New(`error retrieving service foo:bar => service "foo" not found`),
 		},
 		"returns service if found": {
-			&mockClientset{services: []*v1.Service{
+			[]*v1.Service{
 				{
 					ObjectMeta: metav1.ObjectMeta{
 						Name:      "foo",
@@ -104,7 +103,7 @@ func TestServiceCache_getService(t *testing.T) {
 							"my.uri/load-balancer-id": "testing",
 						},
 					},
-				}},
+				},
 			},
 			&namespaceNameKey{name: "foo", namespace: "bar"},
 			&v1.Service{
@@ -126,7 +125,7 @@ func TestServiceCache_getService(t *testing.T) {
 				ServiceAnnotationKeyPrefix:      "my.uri",
 				ServiceAnnotationLoadBalancerId: "testing",
 			},
-			clientset: test.clientset,
+			services: newMockServiceLister(test.services...),
 		}
 
 		svc, err := s.getService(context.Background(), test.namespaceKey)
@@ -149,7 +148,7 @@ func TestServiceCache_lookupService(t *testing.T) {
 			make(map[string]*serviceData),
 			&namespaceNameKey{name: "foo", namespace: "bar"},
 			nil,
-			errors.New("error retrieving service foo:bar => does not exist"),
+			errors.New(`error retrieving service foo:bar => service "foo" not found`),
 		},
 		"returns domain from cache if already set": {
 			nil, // will result in an error if value is not in cache
@@ -190,7 +189,40 @@ func TestServiceCache_lookupService(t *testing.T) {
 			},
 			make(map[string]*serviceData),
 			&namespaceNameKey{name: "foo", namespace: "bar"},
-			&serviceData{domains: []string{"foobar.com"}, healthCheckEndpoint: "/health"},
+			&serviceData{
+				domains:             []string{"foobar.com"},
+				healthCheckEndpoint: "/health",
+				labels:              map[string]string{},
+				annotations:         map[string]string{"domains": "foobar.com", "load-balancer-id": "testing"},
+			},
+			nil,
+		},
+		"retrieves template, labels and prefixed annotations from service": {
+			[]*v1.Service{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "foo",
+						Namespace: "bar",
+						Annotations: map[string]string{
+							"my.uri/domains":          "foobar.com",
+							"my.uri/load-balancer-id": "testing",
+							"my.uri/template":         "tcp",
+							"my.uri/balance":          "leastconn",
+							"other.uri/ignored":       "true",
+						},
+						Labels: map[string]string{"app": "foo"},
+					},
+				},
+			},
+			make(map[string]*serviceData),
+			&namespaceNameKey{name: "foo", namespace: "bar"},
+			&serviceData{
+				domains:             []string{"foobar.com"},
+				healthCheckEndpoint: "/health",
+				template:            "tcp",
+				labels:              map[string]string{"app": "foo"},
+				annotations:         map[string]string{"domains": "foobar.com", "load-balancer-id": "testing", "template": "tcp", "balance": "leastconn"},
+			},
 			nil,
 		},
 	}
@@ -201,7 +233,7 @@ func TestServiceCache_lookupService(t *testing.T) {
 				ServiceAnnotationKeyPrefix:      "my.uri",
 				ServiceAnnotationLoadBalancerId: "testing",
 			},
-			&mockClientset{services: test.services},
+			newMockServiceLister(test.services...),
 		)
 
 		s.domainMapping = test.cache
@@ -246,3 +278,38 @@ func TestServiceCache_removeServiceRecord(t *testing.T) {
 		assert.Equal(t, test.expected, s.domainMapping, name)
 	}
 }
+
+func TestServiceCache_lookupServiceConcurrently(t *testing.T) {
+	s := newServiceCache(
+		&configuration.KubeConfig{
+			ServiceAnnotationKeyPrefix:      "my.uri",
+			ServiceAnnotationLoadBalancerId: "testing",
+		},
+		newMockServiceLister(&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "foo",
+				Namespace: "bar",
+				Annotations: map[string]string{
+					"my.uri/domains":          "foobar.com",
+					"my.uri/load-balancer-id": "testing",
+				},
+			},
+		}),
+	)
+
+	key := &namespaceNameKey{name: "foo", namespace: "bar"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, []string{"foobar.com"}, s.lookupService(context.TODO(), key).domains)
+		}()
+		go func() {
+			defer wg.Done()
+			s.removeServiceRecord(context.TODO(), key)
+		}()
+	}
+	wg.Wait()
+}
@@ -3,22 +3,38 @@ package k8s
 import (
 	"balanced/pkg/types"
 	"fmt"
+	"reflect"
 
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 )
 
 func shouldWatchResource[T NamespacedResource](w *Watcher, obj T) bool {
 	return (w.watchNamespaces.Has(obj.GetNamespace()) || len(w.watchNamespaces) == 0) && !w.excludeNamespaces.Has(obj.GetNamespace())
 }
 
-func endpointHasChanged(oldEndpoint, newEndpoint *corev1.Endpoints) bool {
+// endpointHasChanged reports whether the addresses of an endpoint, or the weight and backup annotations
+// of the pods behind them, differ. Pods are looked up through oldPods and newPods, so that an endpoint
+// can also be compared with itself before and after one of its pods was updated.
+func endpointHasChanged(oldEndpoint, newEndpoint *corev1.Endpoints, oldPods, newPods podLookup) bool {
 	if oldEndpoint.GetResourceVersion() != newEndpoint.GetResourceVersion() {
 		oldIps := types.SortedIPsFromEndpoint(oldEndpoint)
 		newIps := types.SortedIPsFromEndpoint(newEndpoint)
 
-		return !equal(oldIps, newIps)
+		if !equal(oldIps, newIps) {
+			return true
+		}
 	}
-	return false
+
+	return !reflect.DeepEqual(addressOptions(oldEndpoint, oldPods), addressOptions(newEndpoint, newPods))
+}
+
+// endpointSlicesHaveChanged compares the addresses selected across all slices of a service.
+func endpointSlicesHaveChanged(oldSlices, newSlices []*discoveryv1.EndpointSlice) bool {
+	oldIps := types.SortedIPsFromEndpointSlices(oldSlices)
+	newIps := types.SortedIPsFromEndpointSlices(newSlices)
+
+	return !equal(oldIps, newIps)
 }
 
 func equal[T fmt.Stringer](a, b []T) bool {
@@ -6,6 +6,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -148,7 +149,7 @@ func Test_endpointHasChanged(t *testing.T) {
 	}
 
 	for name, test := range tests {
-		res := endpointHasChanged(test.oldEndpoint, test.newEndpoint)
+		res := endpointHasChanged(test.oldEndpoint, test.newEndpoint, nil, nil)
 		assert.Equal(t, test.expectedResult, res, name)
 	}
 }
@@ -198,3 +199,45 @@ func Test_shouldWatchResource(t *testing.T) {
 		assert.Equal(t, test.expectedResult, res, name)
 	}
 }
+
+func Test_endpointSlicesHaveChanged(t *testing.T) {
+	ready, notReady := true, false
+	slice := func(name string, ready *bool, ips ...string) *discoveryv1.EndpointSlice {
+		port := int32(80)
+		s := &discoveryv1.EndpointSlice{
+			ObjectMeta:  metav1.ObjectMeta{Name: name},
+			AddressType: discoveryv1.AddressTypeIPv4,
+			Ports:       []discoveryv1.EndpointPort{{Port: &port}},
+		}
+		for _, ip := range ips {
+			s.Endpoints = append(s.Endpoints, discoveryv1.Endpoint{Addresses: []string{ip}, Conditions: discoveryv1.EndpointConditions{Ready: ready}})
+		}
+		return s
+	}
+
+	tests := map[string]struct {
+		oldSlices      []*discoveryv1.EndpointSlice
+		newSlices      []*discoveryv1.EndpointSlice
+		expectedResult bool
+	}{
+		"has not changed if addresses move between slices": {
+			[]*discoveryv1.EndpointSlice{slice("a", &ready, "10.1.1.1", "10.1.1.2"), slice("b", &ready, "10.1.1.3")},
+			[]*discoveryv1.EndpointSlice{slice("a", &ready, "10.1.1.1"), slice("b", &ready, "10.1.1.3", "10.1.1.2")},
+			false,
+		},
+		"has changed if an address is added in another slice": {
+			[]*discoveryv1.EndpointSlice{slice("a", &ready, "10.1.1.1")},
+			[]*discoveryv1.EndpointSlice{slice("a", &ready, "10.1.1.1"), slice("b", &ready, "10.1.1.2")},
+			true,
+		},
+		"has changed if an endpoint is no longer ready": {
+			[]*discoveryv1.EndpointSlice{slice("a", &ready, "10.1.1.1"), slice("b", &ready, "10.1.1.2")},
+			[]*discoveryv1.EndpointSlice{slice("a", &ready, "10.1.1.1"), slice("b", &notReady, "10.1.1.2")},
+			true,
+		},
+	}
+
+	for name, test := range tests {
+		assert.Equal(t, test.expectedResult, endpointSlicesHaveChanged(test.oldSlices, test.newSlices), name)
+	}
+}
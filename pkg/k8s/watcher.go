@@ -2,20 +2,31 @@ package k8s
 
 import (
 	"balanced/pkg/configuration"
+	"balanced/pkg/queue"
 	"balanced/pkg/types"
 	"context"
+	"fmt"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
 func NewWatcher(cfg *configuration.KubeConfig, opts ...WatchOptions) (*Watcher, error) {
+	switch cfg.EndpointMode {
+	case "":
+		cfg.EndpointMode = configuration.EndpointModeEndpoints
+	case configuration.EndpointModeEndpoints, configuration.EndpointModeEndpointSlices:
+	default:
+		return nil, fmt.Errorf("kubernetes.endpoint-mode: unsupported mode %q", cfg.EndpointMode)
+	}
+
 	config, err := clientcmd.BuildConfigFromFlags("", cfg.GetConfigPath())
 	if err != nil {
 		return nil, err
@@ -32,7 +43,6 @@ func NewWatcher(cfg *configuration.KubeConfig, opts ...WatchOptions) (*Watcher,
 		clientset:         clientset,
 		excludeNamespaces: make(types.Set[string]),
 		watchNamespaces:   make(types.Set[string]),
-		serviceCache:      newServiceCache(cfg, clientset),
 	}
 
 	for _, ns := range cfg.WatchedNamespaces {
@@ -52,6 +62,18 @@ func NewWatcher(cfg *configuration.KubeConfig, opts ...WatchOptions) (*Watcher,
 		w.resyncInterval = &defaultInterval
 	}
 
+	w.informer = kubeinformers.NewSharedInformerFactory(clientset, *w.resyncInterval)
+	w.services = w.informer.Core().V1().Services().Lister()
+	w.pods = w.informer.Core().V1().Pods().Lister()
+
+	// every informer is created here, before the factory is started, so that Start syncs all of them
+	if cfg.EndpointMode == configuration.EndpointModeEndpointSlices {
+		w.endpointSlices = w.informer.Discovery().V1().EndpointSlices().Informer().GetIndexer()
+	} else {
+		w.endpoints = w.informer.Core().V1().Endpoints().Lister()
+	}
+	w.serviceCache = newServiceCache(cfg, w.services)
+
 	return w, nil
 }
 
@@ -63,21 +85,24 @@ type Watcher struct {
 	watchNamespaces   types.Set[string]
 	excludeNamespaces types.Set[string]
 	serviceCache      *serviceCache
+	services          corev1listers.ServiceLister
+	endpoints         corev1listers.EndpointsLister
+	endpointSlices    cache.Indexer
+	pods              corev1listers.PodLister
 }
 
-func (w *Watcher) Start(stop chan struct{}) chan *types.Change {
-	c := w.setup()
+// Start watches services and their endpoints until stop is closed, adding every resulting change to changes.
+func (w *Watcher) Start(stop chan struct{}, changes *queue.Queue) {
+	// services and endpoints are resolved from the local caches, so they must be populated before any event is
+	// handled, the handlers added by setup are then given every cached object as an addition
 	w.informer.Start(stop)
+	w.informer.WaitForCacheSync(stop)
 
-	return c
+	w.setup(changes)
 }
 
-func (w *Watcher) setup() chan *types.Change {
-	kubeInformerFactory := kubeinformers.NewSharedInformerFactory(w.clientset, *w.resyncInterval)
-	endpointsInformer := kubeInformerFactory.Core().V1().Endpoints().Informer()
-	serviceInformer := kubeInformerFactory.Core().V1().Services().Informer()
-
-	c := make(chan *types.Change)
+func (w *Watcher) setup(changes *queue.Queue) {
+	serviceInformer := w.informer.Core().V1().Services().Informer()
 
 	// when a service is updated, this would mean that an annotation may have been added/updated
 	// clear the domain mapping cache to ensure that it can be picked up
@@ -88,23 +113,51 @@ func (w *Watcher) setup() chan *types.Change {
 				key := namespacedResourceToKey(svc)
 				w.serviceCache.removeServiceRecord(context.Background(), key)
 
+				w.handleRemovedDomains(changes, svc, w.domainsOf(svc).Diff(w.domainsOf(newObj.(*corev1.Service))))
+
+				if w.cfg.EndpointMode == configuration.EndpointModeEndpointSlices {
+					w.handleSliceChange(changes, svc.Namespace, svc.Name, w.slicesForService(svc.Namespace, svc.Name))
+					return
+				}
+
 				endpoint, err := w.getEndpointFromService(svc)
 				if err != nil {
 					log.Errorf("unable to retrieve endpoint for svc: %s", key)
 					return
 				}
 
-				w.handleChange(c, endpoint)
+				w.handleChange(changes, endpoint)
 			}
 		},
 		DeleteFunc: func(obj interface{}) {
-			svc := obj.(*corev1.Service)
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+
+			svc, ok := obj.(*corev1.Service)
+			if !ok {
+				return
+			}
+
 			if shouldWatchResource(w, svc) {
 				w.serviceCache.removeServiceRecord(context.Background(), namespacedResourceToKey(svc))
+				w.handleRemovedDomains(changes, svc, w.domainsOf(svc))
 			}
 		},
 	})
 
+	if w.cfg.EndpointMode == configuration.EndpointModeEndpointSlices {
+		w.setupEndpointSlices(w.informer, changes)
+	} else {
+		w.setupEndpoints(w.informer, changes)
+	}
+
+	w.setupPods(changes)
+}
+
+func (w *Watcher) setupEndpoints(kubeInformerFactory kubeinformers.SharedInformerFactory, changes *queue.Queue) {
+	endpointsInformer := kubeInformerFactory.Core().V1().Endpoints().Informer()
+
 	endpointsInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			endpoint := obj.(*corev1.Endpoints)
@@ -113,11 +166,22 @@ func (w *Watcher) setup() chan *types.Change {
 				return
 			}
 
-			w.handleChange(c, endpoint)
+			w.handleChange(changes, endpoint)
 		},
 		DeleteFunc: func(obj interface{}) {
-			key := namespacedResourceToKey(obj.(*corev1.Endpoints))
-			log.Infof("endpoint deleted: %s", key)
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+
+			endpoint, ok := obj.(*corev1.Endpoints)
+			if !ok || !shouldWatchResource(w, endpoint) {
+				return
+			}
+
+			log.Infof("endpoint deleted: %s", namespacedResourceToKey(endpoint))
+
+			// an endpoint without subsets has no ready addresses, leaving the updater to apply the empty upstream policy
+			w.handleChange(changes, &corev1.Endpoints{ObjectMeta: endpoint.ObjectMeta})
 		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
 			oldEndpoint := oldObj.(*corev1.Endpoints)
@@ -128,38 +192,111 @@ func (w *Watcher) setup() chan *types.Change {
 				return
 			}
 
-			if endpointHasChanged(oldEndpoint, newEndpoint) {
-				w.handleChange(c, newEndpoint)
+			if endpointHasChanged(oldEndpoint, newEndpoint, w.currentPodOptions, w.currentPodOptions) {
+				w.handleChange(changes, newEndpoint)
 			}
 		},
 	})
-
-	w.informer = kubeInformerFactory
-	return c
 }
 
 func (w *Watcher) getEndpointFromService(s *corev1.Service) (*corev1.Endpoints, error) {
-	return w.clientset.CoreV1().Endpoints(s.Namespace).Get(context.Background(), s.Name, metav1.GetOptions{})
+	return w.endpoints.Endpoints(s.Namespace).Get(s.Name)
 }
 
-func (w *Watcher) handleChange(c chan *types.Change, e *corev1.Endpoints) {
-	key := namespacedResourceToKey(e)
+func (w *Watcher) handleChange(changes *queue.Queue, e *corev1.Endpoints) {
+	w.queueChanges(changes, namespacedResourceToKey(e), func(domain, healthCheck string) *types.Change {
+		return types.NewLoadBalancerDefinitionChange(domain, healthCheck, e)
+	})
+}
 
+// queueChanges sends a change built by newChange for every domain of the service identified by key.
+func (w *Watcher) queueChanges(changes *queue.Queue, key *namespaceNameKey, newChange func(domain, healthCheck string) *types.Change) {
 	svc := w.serviceCache.lookupService(context.Background(), key)
 
 	if svc == nil || len(svc.domains) == 0 {
 		return
 	}
+
 	for _, domain := range svc.domains {
-		def := types.NewLoadBalancerDefinitionChange(domain, svc.healthCheckEndpoint, e)
+		def := newChange(domain, svc.healthCheckEndpoint)
+		def.Obj.Template = svc.template
+		def.Obj.Labels = svc.labels
+		def.Obj.Annotations = svc.annotations
+		w.applyPodOptions(def.Obj)
 
 		if len(def.Obj.Servers) == 0 {
 			log.Warnf("endpoint %s changed but endpoint has 0 ready addresses", key)
+		} else {
+			log.Infof("endpoint %s changed, queuing update", key)
+		}
+
+		changes.Add(def)
+	}
+}
+
+// domainsOf returns the domains annotated on svc, or none when it does not belong to this load balancer.
+func (w *Watcher) domainsOf(svc *corev1.Service) types.Set[string] {
+	domains := make(types.Set[string])
+	if values, err := w.serviceCache.getDomainFromServiceAnnotation(svc, namespacedResourceToKey(svc)); err == nil {
+		domains.Add(values...)
+	}
+
+	return domains
+}
+
+// Domains returns every domain claimed by a watched service, which is complete once Start has returned.
+func (w *Watcher) Domains() (types.Set[string], error) {
+	services, err := w.services.List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("unable to list services: %s", err)
+	}
+
+	domains := make(types.Set[string])
+	for _, svc := range services {
+		if shouldWatchResource(w, svc) {
+			for domain := range w.domainsOf(svc) {
+				domains.Add(domain)
+			}
+		}
+	}
+
+	return domains, nil
+}
+
+// handleRemovedDomains queues the removal of each domain svc no longer claims, unless another service still claims it.
+func (w *Watcher) handleRemovedDomains(changes *queue.Queue, svc *corev1.Service, removed types.Set[string]) {
+	key := namespacedResourceToKey(svc)
+	for domain := range removed {
+		if w.claimedByOtherService(svc, domain) {
+			log.Infof("domain %s dropped by %s is still claimed by another service, keeping it", domain, key)
 			continue
 		}
 
-		log.Infof("endpoint %s changed, queuing update", key)
+		log.Infof("domain %s is no longer claimed by %s, queuing removal", domain, key)
+		changes.Add(types.NewLoadBalancerDefinitionRemoval(domain, svc.Namespace, svc.Name))
+	}
+}
+
+func (w *Watcher) claimedByOtherService(svc *corev1.Service, domain string) bool {
+	if w.services == nil {
+		return false
+	}
 
-		c <- def
+	services, err := w.services.List(labels.Everything())
+	if err != nil {
+		log.Errorf("unable to list services: %s", err)
+		return false
 	}
+
+	for _, other := range services {
+		if (other.Namespace == svc.Namespace && other.Name == svc.Name) || !shouldWatchResource(w, other) {
+			continue
+		}
+
+		if w.domainsOf(other).Has(domain) {
+			return true
+		}
+	}
+
+	return false
 }
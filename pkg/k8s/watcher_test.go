@@ -1,7 +1,10 @@
 package k8s
 
 import (
+	"balanced/pkg/configuration"
+	"balanced/pkg/queue"
 	"balanced/pkg/types"
+	"sort"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -70,3 +73,92 @@ func TestNamespaceFiltering(t *testing.T) {
 		assert.Equal(t, shouldWatch, test.shouldWatchObject, name)
 	}
 }
+
+func TestWatcher_handleRemovedDomains(t *testing.T) {
+	service := func(name, domains string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				Annotations: map[string]string{
+					"my.uri/domains":          domains,
+					"my.uri/load-balancer-id": "testing",
+				},
+			},
+		}
+	}
+
+	tests := map[string]struct {
+		others          []*corev1.Service
+		removed         types.Set[string]
+		expectedDomains []string
+	}{
+		"queues removal for domains no other service claims": {
+			[]*corev1.Service{service("api", "api.com")},
+			types.Set[string]{"foo.com": {}, "bar.com": {}},
+			[]string{"bar.com", "foo.com"},
+		},
+		"keeps domains still claimed by another service": {
+			[]*corev1.Service{service("api", "api.com,foo.com")},
+			types.Set[string]{"foo.com": {}, "bar.com": {}},
+			[]string{"bar.com"},
+		},
+	}
+
+	for name, test := range tests {
+		services := newMockServiceLister(test.others...)
+
+		w := &Watcher{
+			watchNamespaces:   make(types.Set[string]),
+			excludeNamespaces: make(types.Set[string]),
+			serviceCache: newServiceCache(&configuration.KubeConfig{
+				ServiceAnnotationKeyPrefix:      "my.uri",
+				ServiceAnnotationLoadBalancerId: "testing",
+			}, services),
+			services: services,
+		}
+
+		changes := queue.New(0)
+		w.handleRemovedDomains(changes, service("web", "foo.com,bar.com"), test.removed)
+		changes.ShutDown()
+
+		domains := make([]string, 0)
+		for change, ok := changes.Get(); ok; change, ok = changes.Get() {
+			assert.True(t, change.Removed, name)
+			assert.Equal(t, "web", change.Obj.Service, name)
+			domains = append(domains, change.Obj.Domain)
+			changes.Done(change)
+		}
+		sort.Strings(domains)
+
+		assert.Equal(t, test.expectedDomains, domains, name)
+	}
+}
+
+func TestWatcher_Domains(t *testing.T) {
+	service := func(namespace, name string, annotations map[string]string) *corev1.Service {
+		return &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Annotations: annotations}}
+	}
+
+	services := newMockServiceLister(
+		service("default", "web", map[string]string{"my.uri/domains": "foo.com,bar.com", "my.uri/load-balancer-id": "testing"}),
+		service("default", "api", map[string]string{"my.uri/domains": "api.com", "my.uri/load-balancer-id": "other"}),
+		service("kube-system", "dns", map[string]string{"my.uri/domains": "dns.com", "my.uri/load-balancer-id": "testing"}),
+		service("default", "db", nil),
+	)
+
+	w := &Watcher{
+		watchNamespaces:   make(types.Set[string]),
+		excludeNamespaces: types.Set[string]{"kube-system": {}},
+		serviceCache: newServiceCache(&configuration.KubeConfig{
+			ServiceAnnotationKeyPrefix:      "my.uri",
+			ServiceAnnotationLoadBalancerId: "testing",
+		}, services),
+		services: services,
+	}
+
+	domains, err := w.Domains()
+
+	assert.NoError(t, err)
+	assert.Equal(t, types.Set[string]{"foo.com": {}, "bar.com": {}}, domains)
+}
@@ -0,0 +1,172 @@
+package loadbalancer
+
+import (
+	"balanced/pkg/types"
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// aggregateSyncTimeout is how long the aggregated file is held back for domains claimed on start,
+// the changes of some may never be applied, for instance when they have no ready addresses
+const aggregateSyncTimeout = time.Minute
+
+// applyAggregated re-renders the aggregated file with def added or updated.
+func (b *FileBackend) applyAggregated(def, last *types.LoadBalancerUpstreamDefinition) (bool, error) {
+	b.defs[def.Domain] = def
+
+	// the domains held back are written along with this one, which always takes a reload
+	released := len(b.waiting) > 0
+	if b.holdAggregated(def.Domain) {
+		return false, nil
+	}
+
+	prevs, err := b.renderAggregated()
+	b.remember(def.Domain, prevs...)
+	if err != nil {
+		return len(prevs) > 0, err
+	}
+
+	// every domain, including any held back until now, is in the file
+	for domain, d := range b.defs {
+		b.applied[domain] = d
+	}
+
+	if len(prevs) == 0 {
+		log.Debugf("aggregated configuration is already up to date with %s domain, skipping", def.Domain)
+		return false, nil
+	}
+
+	if !released && b.applyRuntime(def, last) {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// removeAggregated re-renders the aggregated file without the domain.
+func (b *FileBackend) removeAggregated(domain string) (bool, error) {
+	waiting := len(b.waiting) > 0
+	if b.holdAggregated(domain) {
+		delete(b.defs, domain)
+		return false, nil
+	}
+
+	// the file has to be written once it is no longer held back, even without the domain
+	if _, exists := b.defs[domain]; !exists && !waiting {
+		log.Debugf("configuration for %s domain does not exist, skipping", domain)
+		return false, nil
+	}
+
+	delete(b.defs, domain)
+	delete(b.applied, domain)
+
+	prevs, err := b.renderAggregated()
+	b.remember(domain, prevs...)
+
+	return len(prevs) > 0, err
+}
+
+// awaitAggregated holds back writing the aggregated file until every domain in current has been
+// applied, so that the file left by a previous run is not replaced by one holding a few domains.
+func (b *FileBackend) awaitAggregated(current types.Set[string]) {
+	applied := make(types.Set[string])
+	for domain := range b.defs {
+		applied.Add(domain)
+	}
+
+	b.waiting = current.Diff(applied)
+	b.waitingUntil = time.Now().Add(aggregateSyncTimeout)
+
+	if len(b.waiting) > 0 {
+		log.Infof("holding back aggregated configuration until %d domains are applied", len(b.waiting))
+	}
+}
+
+// holdAggregated marks domain as applied and reports whether the aggregated file is still held back.
+func (b *FileBackend) holdAggregated(domain string) bool {
+	if len(b.waiting) == 0 {
+		return false
+	}
+
+	b.waiting.Remove(domain)
+
+	if len(b.waiting) == 0 {
+		log.Info("every domain claimed on start was applied, writing aggregated configuration")
+		return false
+	}
+
+	if time.Now().After(b.waitingUntil) {
+		pending := b.waiting.Values()
+		sort.Strings(pending)
+		log.Warnf("writing aggregated configuration without %s, which were not applied within %s", strings.Join(pending, ", "), aggregateSyncTimeout)
+		b.waiting = nil
+		return false
+	}
+
+	log.Debugf("holding back aggregated configuration for %s domain, %d domains are not applied yet", domain, len(b.waiting))
+
+	return true
+}
+
+// renderAggregated renders every domain into the aggregated file, and the map file when set, returning
+// the replaced versions of the files which changed.
+func (b *FileBackend) renderAggregated() ([]*fileVersion, error) {
+	domains := make([]string, 0, len(b.defs))
+	for domain := range b.defs {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	upstreams := &Upstreams{Upstreams: make([]*types.LoadBalancerUpstreamDefinition, 0, len(domains))}
+	for _, domain := range domains {
+		upstreams.Upstreams = append(upstreams.Upstreams, b.defs[domain])
+	}
+
+	prevs := make([]*fileVersion, 0, 2)
+
+	// the map is written first, so that a reload never sees backends missing from the map it references
+	if b.aggregate.MapFile != "" {
+		upstreams.MapFile = filepath.Join(b.cfg.ConfigDir, b.aggregate.MapFile)
+
+		m := new(bytes.Buffer)
+		for _, def := range upstreams.Upstreams {
+			backend := new(strings.Builder)
+			if err := b.mapBackend.Execute(backend, def); err != nil {
+				return prevs, fmt.Errorf("unable to render map backend for %s: %s", def.Domain, err)
+			}
+
+			fmt.Fprintf(m, "%s %s\n", def.Domain, backend)
+		}
+
+		prev, err := b.writeIfChanged(upstreams.MapFile, m.Bytes())
+		if err != nil {
+			return prevs, err
+		}
+
+		if prev != nil {
+			prevs = append(prevs, prev)
+		}
+	}
+
+	rendered := new(bytes.Buffer)
+	if err := b.render.ToWriterAll(rendered, upstreams); err != nil {
+		return prevs, fmt.Errorf("unable to render aggregated configuration: %s", err)
+	}
+
+	prev, err := b.writeIfChanged(filepath.Join(b.cfg.ConfigDir, b.aggregate.File), rendered.Bytes())
+	if err != nil {
+		return prevs, err
+	}
+
+	if prev != nil {
+		prevs = append(prevs, prev)
+	}
+
+	return prevs, nil
+}
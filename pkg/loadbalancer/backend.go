@@ -0,0 +1,32 @@
+package loadbalancer
+
+import (
+	"balanced/pkg/configuration"
+	"balanced/pkg/types"
+	"fmt"
+)
+
+// Backend applies upstream definitions to a load balancer. Apply and Remove report whether a
+// reload is required for the change to take effect, the updater batches those reloads.
+type Backend interface {
+	Apply(*types.LoadBalancerUpstreamDefinition) (bool, error)
+	Remove(string) (bool, error)
+	Reload() error
+	// RemoveStale removes every domain applied by a previous run which is not in current.
+	RemoveStale(current types.Set[string]) (bool, error)
+	// Validate checks the backend is usable before any change is applied.
+	Validate() error
+	// Stop releases what the backend holds open, it is called once when balanced exits.
+	Stop()
+}
+
+func NewBackend(cfg *configuration.LoadBalancer) (Backend, error) {
+	switch cfg.Type {
+	case configuration.BackendTypeFile:
+		return NewFileBackend(cfg)
+	case configuration.BackendTypeEnvoy:
+		return NewEnvoyBackend(cfg.Envoy)
+	default:
+		return nil, fmt.Errorf("loadbalancer.type: unsupported type %q", cfg.Type)
+	}
+}
@@ -7,27 +7,22 @@ import (
 	"io"
 	"io/fs"
 	"os"
-
-	log "github.com/sirupsen/logrus"
 )
 
-func checksumsEqual(p1, p2 string) (bool, error) {
-	p1CS, p1Err := checksumForFile(p1)
-	p2CS, p2Err := checksumForFile(p2)
-
-	if p1Err != nil {
-		return false, p1Err
-	}
-
-	if p2Err != nil {
-		return false, p2Err
+// checksumEqual reports whether data matches the contents of filePath, which is not equal when it does not exist.
+func checksumEqual(data []byte, filePath string) (bool, error) {
+	fileCS, err := checksumForFile(filePath)
+	if err != nil {
+		return false, err
 	}
 
-	if p1CS == nil || p2CS == nil {
+	if fileCS == nil {
 		return false, nil
 	}
 
-	return bytes.Equal(p1CS, p2CS), nil
+	dataCS := sha256.Sum256(data)
+
+	return bytes.Equal(dataCS[:], fileCS), nil
 }
 
 func checksumForFile(filePath string) ([]byte, error) {
@@ -42,7 +37,7 @@ func checksumForFile(filePath string) ([]byte, error) {
 
 	h := sha256.New()
 	if _, err := io.Copy(h, f); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	return h.Sum(nil), nil
@@ -0,0 +1,34 @@
+package loadbalancer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecksumEqual(t *testing.T) {
+	dir := t.TempDir()
+	fp := filepath.Join(dir, "hi_com.cfg")
+	if err := os.WriteFile(fp, []byte("backend hi.com"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		data     string
+		path     string
+		expected bool
+	}{
+		"equal when contents match":      {"backend hi.com", fp, true},
+		"not equal when contents differ": {"backend bye.com", fp, false},
+		"not equal when file is missing": {"backend hi.com", filepath.Join(dir, "bye_com.cfg"), false},
+	}
+
+	for name, test := range tests {
+		eq, err := checksumEqual([]byte(test.data), test.path)
+
+		assert.NoError(t, err, name)
+		assert.Equal(t, test.expected, eq, name)
+	}
+}
@@ -0,0 +1,295 @@
+package loadbalancer
+
+import (
+	"balanced/pkg/configuration"
+	"balanced/pkg/types"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	clusterservice "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
+	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
+	routeservice "github.com/envoyproxy/go-control-plane/envoy/service/route/v3"
+	cachetypes "github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	serverv3 "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// every Envoy connected to balanced is served the same snapshot
+const envoySnapshotKey = "balanced"
+
+type envoyNodeHash struct{}
+
+func (envoyNodeHash) ID(*corev3.Node) string {
+	return envoySnapshotKey
+}
+
+// EnvoyBackend serves the upstream definitions to Envoy over ADS/xDS. Each change publishes a new
+// versioned snapshot with a cluster, a load assignment and a virtual host per domain, so no
+// configuration file is rendered and nothing is reloaded.
+type EnvoyBackend struct {
+	cfg      *configuration.Envoy
+	cache    cachev3.SnapshotCache
+	server   *grpc.Server
+	listener net.Listener
+	defs     map[string]*types.LoadBalancerUpstreamDefinition
+	version  uint64
+	mx       *sync.Mutex
+}
+
+// Apply publishes a snapshot containing def, Envoy picks it up without a reload.
+func (b *EnvoyBackend) Apply(def *types.LoadBalancerUpstreamDefinition) (bool, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	b.defs[def.Domain] = def
+
+	return false, b.publish()
+}
+
+// Remove publishes a snapshot without the domain.
+func (b *EnvoyBackend) Remove(domain string) (bool, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if _, exists := b.defs[domain]; !exists {
+		return false, nil
+	}
+
+	delete(b.defs, domain)
+
+	return false, b.publish()
+}
+
+// RemoveStale does nothing, snapshots only ever contain domains applied since the backend started.
+func (b *EnvoyBackend) RemoveStale(types.Set[string]) (bool, error) {
+	return false, nil
+}
+
+// Reload does nothing, Envoy applies snapshots as they are published.
+func (b *EnvoyBackend) Reload() error {
+	return nil
+}
+
+// Validate checks every cluster in the snapshot being served has a load assignment. Routes are not
+// checked as the listeners referencing them are part of Envoy's static configuration.
+func (b *EnvoyBackend) Validate() error {
+	snapshot, err := b.cache.GetSnapshot(envoySnapshotKey)
+	if err != nil {
+		return err
+	}
+
+	assignments := snapshot.GetResources(resource.EndpointType)
+	for name := range snapshot.GetResources(resource.ClusterType) {
+		if _, exists := assignments[name]; !exists {
+			return fmt.Errorf("envoy snapshot %s: cluster %s has no load assignment", snapshot.GetVersion(resource.ClusterType), name)
+		}
+	}
+
+	return nil
+}
+
+// Addr returns the address the xDS server is listening on.
+func (b *EnvoyBackend) Addr() net.Addr {
+	return b.listener.Addr()
+}
+
+// Stop closes the xDS server and every stream to it.
+func (b *EnvoyBackend) Stop() {
+	b.server.Stop()
+}
+
+func (b *EnvoyBackend) publish() error {
+	domains := make([]string, 0, len(b.defs))
+	for domain := range b.defs {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	clusters := make([]cachetypes.Resource, 0, len(domains))
+	assignments := make([]cachetypes.Resource, 0, len(domains))
+	routes := &routev3.RouteConfiguration{Name: b.cfg.RouteConfigName}
+
+	for _, domain := range domains {
+		def := b.defs[domain]
+
+		c, err := b.cluster(def)
+		if err != nil {
+			return err
+		}
+
+		clusters = append(clusters, c)
+		assignments = append(assignments, loadAssignment(def))
+		routes.VirtualHosts = append(routes.VirtualHosts, virtualHost(def))
+	}
+
+	b.version++
+	snapshot, err := cachev3.NewSnapshot(strconv.FormatUint(b.version, 10), map[resource.Type][]cachetypes.Resource{
+		resource.ClusterType:  clusters,
+		resource.EndpointType: assignments,
+		resource.RouteType:    {routes},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to build envoy snapshot: %s", err)
+	}
+
+	if err := b.cache.SetSnapshot(context.Background(), envoySnapshotKey, snapshot); err != nil {
+		return fmt.Errorf("unable to publish envoy snapshot %d: %s", b.version, err)
+	}
+
+	log.Debugf("published envoy snapshot %d with %d domains", b.version, len(domains))
+
+	return nil
+}
+
+func (b *EnvoyBackend) cluster(def *types.LoadBalancerUpstreamDefinition) (*clusterv3.Cluster, error) {
+	c := &clusterv3.Cluster{
+		Name:                 def.Domain,
+		ConnectTimeout:       durationpb.New(*b.cfg.ConnectTimeout),
+		ClusterDiscoveryType: &clusterv3.Cluster_Type{Type: clusterv3.Cluster_EDS},
+		LbPolicy:             clusterv3.Cluster_ROUND_ROBIN,
+		EdsClusterConfig: &clusterv3.Cluster_EdsClusterConfig{
+			EdsConfig: &corev3.ConfigSource{
+				ResourceApiVersion:    corev3.ApiVersion_V3,
+				ConfigSourceSpecifier: &corev3.ConfigSource_Ads{Ads: &corev3.AggregatedConfigSource{}},
+			},
+		},
+	}
+
+	if def.HealthCheck != "" {
+		c.HealthChecks = []*corev3.HealthCheck{{
+			Timeout:            durationpb.New(time.Second * 2),
+			Interval:           durationpb.New(time.Second * 5),
+			UnhealthyThreshold: wrapperspb.UInt32(3),
+			HealthyThreshold:   wrapperspb.UInt32(2),
+			HealthChecker: &corev3.HealthCheck_HttpHealthCheck_{
+				HttpHealthCheck: &corev3.HealthCheck_HttpHealthCheck{Host: def.Domain, Path: def.HealthCheck},
+			},
+		}}
+	}
+
+	if b.cfg.UpstreamTLS {
+		tlsContext, err := anypb.New(&tlsv3.UpstreamTlsContext{Sni: def.Domain})
+		if err != nil {
+			return nil, fmt.Errorf("unable to build upstream tls context for %s: %s", def.Domain, err)
+		}
+
+		c.TransportSocket = &corev3.TransportSocket{
+			Name:       wellknown.TransportSocketTLS,
+			ConfigType: &corev3.TransportSocket_TypedConfig{TypedConfig: tlsContext},
+		}
+	}
+
+	return c, nil
+}
+
+// loadAssignment groups the servers of def by zone, so Envoy can apply zone aware routing.
+func loadAssignment(def *types.LoadBalancerUpstreamDefinition) *endpointv3.ClusterLoadAssignment {
+	byZone := make(map[string][]*endpointv3.LbEndpoint)
+	zones := make([]string, 0)
+
+	for _, srv := range def.Servers {
+		zone := ""
+		if srv.Meta != nil {
+			zone = srv.Meta.Zone
+		}
+
+		if _, exists := byZone[zone]; !exists {
+			zones = append(zones, zone)
+		}
+
+		byZone[zone] = append(byZone[zone], &endpointv3.LbEndpoint{
+			HostIdentifier: &endpointv3.LbEndpoint_Endpoint{
+				Endpoint: &endpointv3.Endpoint{
+					Address: &corev3.Address{
+						Address: &corev3.Address_SocketAddress{
+							SocketAddress: &corev3.SocketAddress{
+								Address:       srv.IPAddress,
+								PortSpecifier: &corev3.SocketAddress_PortValue{PortValue: uint32(srv.Port)},
+							},
+						},
+					},
+				},
+			},
+		})
+	}
+	sort.Strings(zones)
+
+	cla := &endpointv3.ClusterLoadAssignment{ClusterName: def.Domain}
+	for _, zone := range zones {
+		cla.Endpoints = append(cla.Endpoints, &endpointv3.LocalityLbEndpoints{
+			Locality:    &corev3.Locality{Zone: zone},
+			LbEndpoints: byZone[zone],
+		})
+	}
+
+	return cla
+}
+
+func virtualHost(def *types.LoadBalancerUpstreamDefinition) *routev3.VirtualHost {
+	return &routev3.VirtualHost{
+		Name:    def.Domain,
+		Domains: []string{def.Domain},
+		Routes: []*routev3.Route{{
+			Match: &routev3.RouteMatch{PathSpecifier: &routev3.RouteMatch_Prefix{Prefix: "/"}},
+			Action: &routev3.Route_Route{
+				Route: &routev3.RouteAction{ClusterSpecifier: &routev3.RouteAction_Cluster{Cluster: def.Domain}},
+			},
+		}},
+	}
+}
+
+// NewEnvoyBackend starts serving an empty snapshot over ADS, as well as the separate CDS, EDS and RDS
+// services, on the configured address.
+func NewEnvoyBackend(cfg *configuration.Envoy) (*EnvoyBackend, error) {
+	l, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("loadbalancer.envoy: unable to listen on %s: %s", cfg.Listen, err)
+	}
+
+	b := &EnvoyBackend{
+		cfg:      cfg,
+		cache:    cachev3.NewSnapshotCache(true, envoyNodeHash{}, log.StandardLogger()),
+		server:   grpc.NewServer(),
+		listener: l,
+		defs:     make(map[string]*types.LoadBalancerUpstreamDefinition),
+		mx:       &sync.Mutex{},
+	}
+
+	if err := b.publish(); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	srv := serverv3.NewServer(context.Background(), b.cache, nil)
+	discoverygrpc.RegisterAggregatedDiscoveryServiceServer(b.server, srv)
+	clusterservice.RegisterClusterDiscoveryServiceServer(b.server, srv)
+	endpointservice.RegisterEndpointDiscoveryServiceServer(b.server, srv)
+	routeservice.RegisterRouteDiscoveryServiceServer(b.server, srv)
+
+	go func() {
+		log.Infof("serving envoy xds on %s", l.Addr())
+		if err := b.server.Serve(l); err != nil {
+			log.Errorf("envoy xds server stopped: %s", err)
+		}
+	}()
+
+	return b, nil
+}
@@ -0,0 +1,144 @@
+package loadbalancer
+
+import (
+	"balanced/pkg/configuration"
+	"balanced/pkg/types"
+	"context"
+	"testing"
+	"time"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/proto"
+)
+
+// testADSClient is a minimal in-process xDS client speaking ADS to the backend.
+type testADSClient struct {
+	t      *testing.T
+	stream discoverygrpc.AggregatedDiscoveryService_StreamAggregatedResourcesClient
+}
+
+func newTestADSClient(t *testing.T, b *EnvoyBackend) *testADSClient {
+	conn, err := grpc.Dial(b.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	t.Cleanup(cancel)
+
+	stream, err := discoverygrpc.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testADSClient{t: t, stream: stream}
+}
+
+// fetch requests typeURL, acknowledging version, and returns the response.
+func (c *testADSClient) fetch(typeURL, version string, names ...string) *discoverygrpc.DiscoveryResponse {
+	err := c.stream.Send(&discoverygrpc.DiscoveryRequest{
+		Node:          &corev3.Node{Id: "edge-1"},
+		TypeUrl:       typeURL,
+		VersionInfo:   version,
+		ResourceNames: names,
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	resp, err := c.stream.Recv()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	return resp
+}
+
+func testUnmarshal[T proto.Message](t *testing.T, resp *discoverygrpc.DiscoveryResponse, newMsg func() T) []T {
+	msgs := make([]T, 0, len(resp.Resources))
+	for _, r := range resp.Resources {
+		msg := newMsg()
+		if err := r.UnmarshalTo(msg); err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return msgs
+}
+
+func newTestEnvoyBackend(t *testing.T) *EnvoyBackend {
+	timeout := time.Second
+	b, err := NewEnvoyBackend(&configuration.Envoy{Listen: "127.0.0.1:0", RouteConfigName: "balanced", ConnectTimeout: &timeout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(b.Stop)
+
+	return b
+}
+
+func TestEnvoyBackend_Apply(t *testing.T) {
+	b := newTestEnvoyBackend(t)
+
+	reload, err := b.Apply(&types.LoadBalancerUpstreamDefinition{
+		Domain:      "hi.com",
+		HealthCheck: "/health",
+		Servers: []*types.Server{
+			{Id: "one", IPAddress: "10.1.1.1", Port: 8443, Meta: &types.ServerMeta{Zone: "eu-west-1a"}},
+			{Id: "two", IPAddress: "10.1.1.2", Port: 8443, Meta: &types.ServerMeta{Zone: "eu-west-1b"}},
+		},
+	})
+	assert.Nil(t, err)
+	assert.False(t, reload)
+	assert.Nil(t, b.Validate())
+
+	client := newTestADSClient(t, b)
+
+	resp := client.fetch(resource.ClusterType, "")
+	assert.Equal(t, "2", resp.VersionInfo)
+
+	clusters := testUnmarshal(t, resp, func() *clusterv3.Cluster { return &clusterv3.Cluster{} })
+	assert.Len(t, clusters, 1)
+	assert.Equal(t, "hi.com", clusters[0].Name)
+	assert.Equal(t, "/health", clusters[0].HealthChecks[0].GetHttpHealthCheck().Path)
+
+	resp = client.fetch(resource.EndpointType, "", "hi.com")
+	assignments := testUnmarshal(t, resp, func() *endpointv3.ClusterLoadAssignment { return &endpointv3.ClusterLoadAssignment{} })
+	assert.Len(t, assignments, 1)
+	assert.Len(t, assignments[0].Endpoints, 2)
+	assert.Equal(t, "eu-west-1a", assignments[0].Endpoints[0].Locality.Zone)
+	assert.Equal(t, "10.1.1.1", assignments[0].Endpoints[0].LbEndpoints[0].GetEndpoint().Address.GetSocketAddress().Address)
+
+	resp = client.fetch(resource.RouteType, "", "balanced")
+	routes := testUnmarshal(t, resp, func() *routev3.RouteConfiguration { return &routev3.RouteConfiguration{} })
+	assert.Len(t, routes, 1)
+	assert.Equal(t, []string{"hi.com"}, routes[0].VirtualHosts[0].Domains)
+}
+
+func TestEnvoyBackend_Remove(t *testing.T) {
+	b := newTestEnvoyBackend(t)
+
+	b.Apply(&types.LoadBalancerUpstreamDefinition{Domain: "hi.com"})
+	b.Apply(&types.LoadBalancerUpstreamDefinition{Domain: "bye.com"})
+
+	reload, err := b.Remove("bye.com")
+	assert.Nil(t, err)
+	assert.False(t, reload)
+
+	resp := newTestADSClient(t, b).fetch(resource.ClusterType, "")
+	assert.Equal(t, "4", resp.VersionInfo)
+
+	clusters := testUnmarshal(t, resp, func() *clusterv3.Cluster { return &clusterv3.Cluster{} })
+	assert.Len(t, clusters, 1)
+	assert.Equal(t, "hi.com", clusters[0].Name)
+}
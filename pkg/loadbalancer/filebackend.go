@@ -0,0 +1,631 @@
+package loadbalancer
+
+import (
+	"balanced/pkg/configuration"
+	"balanced/pkg/types"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/google/shlex"
+	log "github.com/sirupsen/logrus"
+)
+
+// managedFileName is the file within config-dir listing the domains balanced has written a file for
+const managedFileName = ".managed"
+
+// FileBackend renders a configuration file per domain, or a single file for every domain when
+// aggregate is enabled, into config-dir and reloads the load balancer with reload-cmd.
+type FileBackend struct {
+	cfg      *configuration.LoadBalancer
+	render   *Renderer
+	runtime  *RuntimeAPI
+	validate *template.Template
+	history  *history
+
+	// last definition written per domain, to tell whether a change is limited to servers, it is
+	// forgotten when the domain's file is restored
+	applied map[string]*types.LoadBalancerUpstreamDefinition
+
+	// set when aggregate is enabled, each change re-renders the aggregated file from defs
+	aggregate  *configuration.Aggregate
+	mapBackend *template.Template
+	defs       map[string]*types.LoadBalancerUpstreamDefinition
+	// domains claimed on start which have not been applied yet, the aggregated file is not written
+	// until they are so that it never lacks them, or until waitingUntil has passed
+	waiting      types.Set[string]
+	waitingUntil time.Time
+
+	// domains whose files were written by balanced, persisted in config-dir/.managed so files
+	// left behind by a previous run can be told apart from files balanced did not create
+	managed types.Set[string]
+	// managed domains from before the first change since the last reload, put back with the files
+	previousManaged types.Set[string]
+
+	// contents of the files changed since the last reload by path, restored when validation fails,
+	// and the domains whose changes touched them
+	previous map[string]*fileVersion
+	changed  types.Set[string]
+}
+
+type fileVersion struct {
+	path    string
+	data    []byte
+	existed bool
+}
+
+// ValidationError is returned by Reload when validate-cmd rejects the rendered configuration, by
+// which time the previous versions of the changed files have been restored.
+type ValidationError struct {
+	Domains []string
+	Output  string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("configuration for %s failed validation and was restored: %s", strings.Join(e.Domains, ", "), e.Output)
+}
+
+// Apply renders the domain's configuration file, returning whether a reload is required. With the
+// runtime api enabled, servers are updated in place and a reload is only required when that fails.
+func (b *FileBackend) Apply(change *types.LoadBalancerUpstreamDefinition) (bool, error) {
+	if b.applied == nil {
+		b.applied = make(map[string]*types.LoadBalancerUpstreamDefinition)
+	}
+
+	last := b.applied[change.Domain]
+
+	if b.aggregate != nil {
+		return b.applyAggregated(change, last)
+	}
+
+	rendered := new(bytes.Buffer)
+	if err := b.render.ToWriter(rendered, change); err != nil {
+		return false, fmt.Errorf("unable to render configuration for %s: %w", change.Domain, err)
+	}
+
+	prev, err := b.writeIfChanged(filepath.Join(b.cfg.ConfigDir, configFilename(change.Domain)), rendered.Bytes())
+	if err != nil {
+		return false, err
+	}
+
+	if prev == nil {
+		log.Debugf("configuration for %s domain is already up to date, skipping", change.Domain)
+		b.applied[change.Domain] = change
+		return false, nil
+	}
+
+	if err := b.manage(change.Domain, true); err != nil {
+		return false, err
+	}
+	b.applied[change.Domain] = change
+
+	if b.applyRuntime(change, last) {
+		return false, nil
+	}
+
+	b.remember(change.Domain, prev)
+
+	return true, nil
+}
+
+// applyRuntime tries to apply the servers of change through the runtime api, returning whether a
+// reload can be skipped. That is only the case when nothing but the servers changed since last,
+// other changes such as annotations can affect more than servers. Files are kept up to date
+// either way so that the next reload does not revert runtime changes.
+func (b *FileBackend) applyRuntime(change, last *types.LoadBalancerUpstreamDefinition) bool {
+	if b.runtime == nil || !onlyServersChanged(last, change) || backupsChanged(last, change) {
+		return false
+	}
+
+	err := b.runtime.Apply(change)
+	if err == nil {
+		log.Debugf("applied servers for %s domain through the runtime api", change.Domain)
+		return true
+	}
+
+	if errors.Is(err, errReloadRequired) {
+		log.Infof("unable to apply %s domain through the runtime api, reloading: %s", change.Domain, err)
+	} else {
+		log.Warnf("unable to apply %s domain through the runtime api, reloading: %s", change.Domain, err)
+	}
+
+	return false
+}
+
+func onlyServersChanged(a, b *types.LoadBalancerUpstreamDefinition) bool {
+	if a == nil || b == nil {
+		return false
+	}
+
+	withoutServers := func(def *types.LoadBalancerUpstreamDefinition) types.LoadBalancerUpstreamDefinition {
+		d := *def
+		d.Servers = nil
+		return d
+	}
+
+	return reflect.DeepEqual(withoutServers(a), withoutServers(b))
+}
+
+// backupsChanged reports whether a server present in both a and b became or stopped being a backup,
+// which can only be applied with a reload.
+func backupsChanged(a, b *types.LoadBalancerUpstreamDefinition) bool {
+	backups := make(map[string]bool)
+	for _, srv := range a.Servers {
+		backups[net.JoinHostPort(srv.IPAddress, strconv.Itoa(int(srv.Port)))] = srv.Backup
+	}
+
+	for _, srv := range b.Servers {
+		if backup, exists := backups[net.JoinHostPort(srv.IPAddress, strconv.Itoa(int(srv.Port)))]; exists && backup != srv.Backup {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeIfChanged writes data to path unless it already holds it, keeping the replaced version in the
+// history. The replaced version is returned, or nil when path was already up to date.
+func (b *FileBackend) writeIfChanged(path string, data []byte) (*fileVersion, error) {
+	areEq, err := checksumEqual(data, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if areEq {
+		return nil, nil
+	}
+
+	log.Debugf("configuration file %s has changed, updating", path)
+
+	prev, err := b.saveHistory(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tryWriteToFile(path, data); err != nil {
+		return nil, err
+	}
+
+	log.Debugf("successfully updated configuration file %s", path)
+
+	return prev, nil
+}
+
+// Remove deletes the configuration file of a domain which is no longer claimed by any service.
+func (b *FileBackend) Remove(domain string) (bool, error) {
+	if b.aggregate != nil {
+		return b.removeAggregated(domain)
+	}
+
+	fullFilePath := filepath.Join(b.cfg.ConfigDir, configFilename(domain))
+
+	prev, err := b.saveHistory(fullFilePath)
+	if err != nil {
+		return false, err
+	}
+
+	if err := os.Remove(fullFilePath); err != nil {
+		if os.IsNotExist(err) {
+			log.Debugf("configuration for %s domain does not exist, skipping", domain)
+			return false, b.manage(domain, false)
+		}
+
+		return false, fmt.Errorf("unable to remove %s: %s", fullFilePath, err)
+	}
+
+	if err := b.manage(domain, false); err != nil {
+		return false, err
+	}
+	delete(b.applied, domain)
+
+	log.Debugf("successfully removed configuration file %s", fullFilePath)
+	b.remember(domain, prev)
+
+	return true, nil
+}
+
+// RemoveStale removes the files of domains written by balanced which are not in current, so that
+// domains deleted while balanced was not running do not linger. Their last version is kept in the
+// history and files balanced did not write are left alone. The aggregated file always holds
+// exactly the domains applied since starting, so when aggregate is enabled it is instead held back
+// until every domain in current has been applied.
+func (b *FileBackend) RemoveStale(current types.Set[string]) (bool, error) {
+	if b.aggregate != nil {
+		b.awaitAggregated(current)
+		return false, nil
+	}
+
+	reload := false
+
+	for domain := range b.managed.Diff(current) {
+		log.Infof("%s domain is no longer claimed by any service, removing its configuration", domain)
+
+		removed, err := b.Remove(domain)
+		if err != nil {
+			return reload, err
+		}
+
+		reload = reload || removed
+	}
+
+	return reload, nil
+}
+
+// manage records whether the domain's file is written by balanced.
+func (b *FileBackend) manage(domain string, managed bool) error {
+	if b.managed == nil || b.managed.Has(domain) == managed {
+		return nil
+	}
+
+	if b.previousManaged == nil {
+		b.previousManaged = b.managed.Diff(make(types.Set[string]))
+	}
+
+	if managed {
+		b.managed.Add(domain)
+	} else {
+		b.managed.Remove(domain)
+	}
+
+	return b.writeManaged()
+}
+
+// writeManaged persists the managed domains to config-dir/.managed.
+func (b *FileBackend) writeManaged() error {
+	domains := make([]string, 0, len(b.managed))
+	for d := range b.managed {
+		domains = append(domains, d)
+	}
+	sort.Strings(domains)
+
+	data := strings.Join(domains, "\n")
+	if len(domains) > 0 {
+		data += "\n"
+	}
+
+	return tryWriteToFile(filepath.Join(b.cfg.ConfigDir, managedFileName), []byte(data))
+}
+
+// Reload runs reload-cmd so the load balancer picks up rewritten configuration files. When
+// validate-cmd is set it has to succeed first, otherwise the changed files are restored and
+// a *ValidationError is returned instead.
+func (b *FileBackend) Reload() error {
+	if b.validate != nil {
+		if output, err := b.runValidate(); err != nil {
+			return b.restore(output, err)
+		}
+	}
+
+	b.previous = make(map[string]*fileVersion)
+	b.changed = make(types.Set[string])
+	b.previousManaged = nil
+
+	cmdParts, err := shlex.Split(b.cfg.ReloadCmd)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(cmdParts[0], cmdParts[1:]...)
+	return cmd.Run()
+}
+
+// Rollback restores a revision of the domain's configuration file from config-dir/.history, the latest
+// one when revision is 0, and reloads. With aggregate enabled that is the aggregated file whichever
+// domain is given. The current file is saved to the history first, so a rollback can itself be
+// rolled back. The restored revision is returned.
+func (b *FileBackend) Rollback(domain string, revision int) (int, error) {
+	filename := b.filename(domain)
+
+	if revision == 0 {
+		revisions, err := b.history.revisions(filename)
+		if err != nil {
+			return 0, err
+		}
+
+		if len(revisions) == 0 {
+			return 0, fmt.Errorf("no previous revision of %s domain is kept", domain)
+		}
+
+		revision = revisions[len(revisions)-1]
+	}
+
+	data, err := b.history.read(filename, revision)
+	if err != nil {
+		return 0, err
+	}
+
+	fullFilePath := filepath.Join(b.cfg.ConfigDir, filename)
+
+	prev, err := b.saveHistory(fullFilePath)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tryWriteToFile(fullFilePath, data); err != nil {
+		return 0, err
+	}
+
+	if b.aggregate == nil {
+		if err := b.manage(domain, true); err != nil {
+			return 0, err
+		}
+	}
+
+	b.remember(domain, prev)
+
+	return revision, b.Reload()
+}
+
+// filename returns the name of the file within config-dir holding the domain's configuration.
+func (b *FileBackend) filename(domain string) string {
+	if b.aggregate != nil {
+		return b.aggregate.File
+	}
+
+	return configFilename(domain)
+}
+
+// saveHistory reads the current version of a file and keeps it as a new revision before it is replaced.
+func (b *FileBackend) saveHistory(fullFilePath string) (*fileVersion, error) {
+	prev, err := readFileVersion(fullFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if prev.existed {
+		if _, err := b.history.save(filepath.Base(fullFilePath), prev.data); err != nil {
+			return nil, err
+		}
+	}
+
+	return prev, nil
+}
+
+// remember keeps the versions of the files changed for a domain from before they were first changed
+// since the last reload.
+func (b *FileBackend) remember(domain string, prevs ...*fileVersion) {
+	if b.previous == nil {
+		b.previous = make(map[string]*fileVersion)
+	}
+
+	if b.changed == nil {
+		b.changed = make(types.Set[string])
+	}
+
+	b.changed.Add(domain)
+	for _, prev := range prevs {
+		if _, exists := b.previous[prev.path]; !exists {
+			b.previous[prev.path] = prev
+		}
+	}
+}
+
+func (b *FileBackend) runValidate() (string, error) {
+	cmdText := new(strings.Builder)
+	if err := b.validate.Execute(cmdText, b.cfg); err != nil {
+		return "", fmt.Errorf("loadbalancer.validate-cmd: %s", err)
+	}
+
+	cmdParts, err := shlex.Split(cmdText.String())
+	if err != nil {
+		return "", err
+	}
+
+	output, err := exec.Command(cmdParts[0], cmdParts[1:]...).CombinedOutput()
+
+	return strings.TrimSpace(string(output)), err
+}
+
+// restore puts back the previous version of every file changed since the last reload, along with
+// the managed domains, reporting the domains named in the validator's output, or all changed domains
+// when none are.
+func (b *FileBackend) restore(output string, validateErr error) error {
+	for path, prev := range b.previous {
+		if err := prev.restore(); err != nil {
+			log.Errorf("unable to restore configuration file %s: %s", path, err)
+		}
+	}
+
+	if b.previousManaged != nil {
+		b.managed = b.previousManaged
+		b.previousManaged = nil
+
+		if err := b.writeManaged(); err != nil {
+			log.Errorf("unable to restore %s: %s", managedFileName, err)
+		}
+	}
+
+	changed := make([]string, 0, len(b.changed))
+	offending := make([]string, 0)
+
+	for domain := range b.changed {
+		delete(b.applied, domain)
+		changed = append(changed, domain)
+		if strings.Contains(output, b.filename(domain)) {
+			offending = append(offending, domain)
+		}
+	}
+
+	b.previous = make(map[string]*fileVersion)
+	b.changed = make(types.Set[string])
+
+	if len(offending) == 0 {
+		offending = changed
+	}
+	sort.Strings(offending)
+
+	if output == "" {
+		output = validateErr.Error()
+	}
+
+	return &ValidationError{Domains: offending, Output: output}
+}
+
+func readFileVersion(path string) (*fileVersion, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &fileVersion{path: path}, nil
+		}
+
+		return nil, fmt.Errorf("unable to read %s: %s", path, err)
+	}
+
+	return &fileVersion{path: path, data: data, existed: true}, nil
+}
+
+func (v *fileVersion) restore() error {
+	if !v.existed {
+		if err := os.Remove(v.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	return tryWriteToFile(v.path, v.data)
+}
+
+// Stop does nothing, the load balancer keeps serving the rendered configuration.
+func (b *FileBackend) Stop() {}
+
+// Validate checks config-dir is a directory and reload-cmd can be parsed.
+func (b *FileBackend) Validate() error {
+	info, err := os.Stat(b.cfg.ConfigDir)
+	if err != nil {
+		return fmt.Errorf("loadbalancer.config-dir: %s", err)
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("loadbalancer.config-dir: %s is not a directory", b.cfg.ConfigDir)
+	}
+
+	if cmdParts, err := shlex.Split(b.cfg.ReloadCmd); err != nil || len(cmdParts) == 0 {
+		return fmt.Errorf("loadbalancer.reload-cmd: unable to parse %q", b.cfg.ReloadCmd)
+	}
+
+	if b.validate != nil {
+		cmdText := new(strings.Builder)
+		if err := b.validate.Execute(cmdText, b.cfg); err != nil {
+			return fmt.Errorf("loadbalancer.validate-cmd: %s", err)
+		}
+
+		if cmdParts, err := shlex.Split(cmdText.String()); err != nil || len(cmdParts) == 0 {
+			return fmt.Errorf("loadbalancer.validate-cmd: unable to parse %q", cmdText)
+		}
+	}
+
+	if b.aggregate != nil {
+		for _, name := range []string{b.aggregate.File, b.aggregate.MapFile} {
+			if name != "" && filepath.Base(name) != name {
+				return fmt.Errorf("loadbalancer.aggregate: %s must be a file name within config-dir", name)
+			}
+		}
+
+		if b.aggregate.File == "" {
+			return errors.New("loadbalancer.aggregate.file must be set")
+		}
+	}
+
+	return nil
+}
+
+func readManaged(path string) (types.Set[string], error) {
+	managed := make(types.Set[string])
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// versions before .managed was introduced did not record the files they wrote
+			if files, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*.cfg")); len(files) > 0 {
+				log.Warnf("%s does not exist, %d configuration files in %s are left alone unless their domains are listed in it, one per line",
+					path, len(files), filepath.Dir(path))
+			}
+			return managed, nil
+		}
+		return nil, fmt.Errorf("unable to read %s: %s", path, err)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if domain := strings.TrimSpace(line); domain != "" {
+			managed.Add(domain)
+		}
+	}
+
+	return managed, nil
+}
+
+func configFilename(domain string) string {
+	return strings.ReplaceAll(domain, ".", "_") + ".cfg"
+}
+
+func tryWriteToFile(fullFilePath string, data []byte) error {
+	return writeFileAtomic(fullFilePath, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+func NewFileBackend(cfg *configuration.LoadBalancer) (*FileBackend, error) {
+	templateText, err := cfg.TemplateText()
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := NewRenderer(templateText, cfg.TemplateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &FileBackend{
+		cfg:      cfg,
+		render:   r,
+		history:  &history{dir: filepath.Join(cfg.ConfigDir, historyDirName)},
+		previous: make(map[string]*fileVersion),
+		changed:  make(types.Set[string]),
+	}
+
+	if agg := cfg.Aggregate; agg != nil && agg.Enabled {
+		b.aggregate = agg
+		b.defs = make(map[string]*types.LoadBalancerUpstreamDefinition)
+
+		b.mapBackend, err = template.New("map-backend").Funcs(Funcs()).Parse(agg.MapBackend)
+		if err != nil {
+			return nil, fmt.Errorf("loadbalancer.aggregate.map-backend: %s", err)
+		}
+	}
+
+	if cfg.HistoryLimit != nil {
+		b.history.limit = *cfg.HistoryLimit
+	}
+
+	b.managed, err = readManaged(filepath.Join(cfg.ConfigDir, managedFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.ValidateCmd != "" {
+		b.validate, err = template.New("validate-cmd").Parse(cfg.ValidateCmd)
+		if err != nil {
+			return nil, fmt.Errorf("loadbalancer.validate-cmd: %s", err)
+		}
+	}
+
+	if rt := cfg.RuntimeAPI; rt != nil && rt.Enabled {
+		b.runtime, err = NewRuntimeAPI(rt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
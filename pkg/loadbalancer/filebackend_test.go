@@ -0,0 +1,516 @@
+package loadbalancer
+
+import (
+	"balanced/pkg/configuration"
+	"balanced/pkg/types"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type setupChangeTestHandler func(*configuration.LoadBalancer, *types.LoadBalancerUpstreamDefinition)
+
+func testRenderTemplate(text string, obj interface{}) string {
+	t := template.Must(template.New("foobar").Parse(text))
+
+	b := new(strings.Builder)
+
+	if err := t.Execute(b, obj); err != nil {
+		return err.Error()
+	}
+
+	return b.String()
+}
+
+func testReadFile(fp string) string {
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return err.Error()
+	}
+
+	return string(data)
+}
+
+func TestFileBackend_Apply(t *testing.T) {
+	templateText := `backend {{.Domain}}
+  balance roundrobin
+  {{range .Servers -}}
+  server {{.Id}} {{.IPAddress}}:{{.Port}} check check-ssl
+  {{end}}`
+
+	servers := []*types.Server{
+		{Id: "one", IPAddress: "10.1.1.1", Port: 80},
+		{Id: "two", IPAddress: "10.1.1.2", Port: 80},
+		{Id: "three", IPAddress: "10.1.1.3", Port: 80},
+	}
+
+	tests := map[string]struct {
+		cfg         *configuration.LoadBalancer
+		change      *types.LoadBalancerUpstreamDefinition
+		setup       setupChangeTestHandler
+		expectedErr error
+		verify      func(string)
+	}{
+		"returns error when file path does not exist": {
+			&configuration.LoadBalancer{Template: templateText, ReloadCmd: "ls -al", ConfigDir: "/foob"},
+			&types.LoadBalancerUpstreamDefinition{Domain: "hi.com"},
+			func(*configuration.LoadBalancer, *types.LoadBalancerUpstreamDefinition) {},
+			errors.New("unable to open /foob/hi_com.cfg: no such file or directory"),
+			func(string) {},
+		},
+		"creates file if it does not exist and populates": {
+			&configuration.LoadBalancer{Template: templateText, ReloadCmd: "ls -al", ConfigDir: "/tmp"},
+			&types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Servers: servers},
+			func(*configuration.LoadBalancer, *types.LoadBalancerUpstreamDefinition) {},
+			nil,
+			func(name string) {
+				fp := "/tmp/hi_com.cfg"
+				defer os.Remove(fp)
+
+				assert.Equal(t, testRenderTemplate(templateText, &types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Servers: servers}), testReadFile(fp), name)
+			},
+		},
+		"updates existing file": {
+			&configuration.LoadBalancer{Template: templateText, ReloadCmd: "ls -al", ConfigDir: "/tmp"},
+			&types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Servers: servers[2:]},
+			func(lb *configuration.LoadBalancer, def *types.LoadBalancerUpstreamDefinition) {
+				f, err := os.Create(lb.ConfigDir + "/hi_com.cfg")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				f.WriteString(testRenderTemplate(templateText, def))
+			},
+			nil,
+			func(name string) {
+				fp := "/tmp/hi_com.cfg"
+				defer os.Remove(fp)
+
+				assert.Equal(t, testRenderTemplate(templateText, &types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Servers: servers[2:]}), testReadFile(fp), name)
+			},
+		},
+	}
+
+	for name, test := range tests {
+		test.setup(test.cfg, test.change)
+
+		b := &FileBackend{
+			cfg:    test.cfg,
+			render: &Renderer{t: template.Must(template.New("foo").Parse(templateText))},
+		}
+
+		_, err := b.Apply(test.change)
+
+		assert.Equal(t, test.expectedErr, err, name)
+		test.verify(name)
+	}
+}
+
+func TestFileBackend_Remove(t *testing.T) {
+	tests := map[string]struct {
+		setup          func(string)
+		expectedReload bool
+	}{
+		"removes existing file and requires reload": {
+			func(fp string) {
+				if err := os.WriteFile(fp, []byte("backend hi.com"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			true,
+		},
+		"does nothing when file does not exist": {
+			func(string) {},
+			false,
+		},
+	}
+
+	for name, test := range tests {
+		dir := t.TempDir()
+		fp := filepath.Join(dir, "hi_com.cfg")
+		test.setup(fp)
+
+		b := &FileBackend{cfg: &configuration.LoadBalancer{ConfigDir: dir}}
+
+		reload, err := b.Remove("hi.com")
+
+		assert.NoError(t, err, name)
+		assert.NoFileExists(t, fp, name)
+		assert.Equal(t, test.expectedReload, reload, name)
+	}
+}
+
+func TestFileBackend_ReloadRestoresFilesWhenValidationFails(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "hi_com.cfg")
+	if err := os.WriteFile(existing, []byte("backend hi.com"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		validateCmd     string
+		expectedDomains []string
+		expectedErr     bool
+	}{
+		"reloads when validation succeeds": {
+			"true {{.ConfigDir}}",
+			nil,
+			false,
+		},
+		"reports the domains named in the validator output": {
+			`sh -c "echo parsing {{.ConfigDir}}/hi_com.cfg failed; exit 1"`,
+			[]string{"hi.com"},
+			true,
+		},
+		"reports every changed domain when none are named": {
+			"false",
+			[]string{"bye.com", "hi.com"},
+			true,
+		},
+	}
+
+	for name, test := range tests {
+		b, err := NewFileBackend(&configuration.LoadBalancer{
+			Template:    "backend {{.Domain}} {{len .Servers}}",
+			ReloadCmd:   "true",
+			ValidateCmd: test.validateCmd,
+			ConfigDir:   dir,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = b.Apply(&types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Servers: []*types.Server{{Id: "one"}}})
+		assert.NoError(t, err, name)
+		_, err = b.Apply(&types.LoadBalancerUpstreamDefinition{Domain: "bye.com"})
+		assert.NoError(t, err, name)
+
+		err = b.Reload()
+
+		if !test.expectedErr {
+			assert.NoError(t, err, name)
+			assert.Equal(t, "backend hi.com 1", testReadFile(existing), name)
+			assert.FileExists(t, filepath.Join(dir, "bye_com.cfg"), name)
+		} else {
+			var validationErr *ValidationError
+			assert.True(t, errors.As(err, &validationErr), name)
+			assert.Equal(t, test.expectedDomains, validationErr.Domains, name)
+			assert.Equal(t, "backend hi.com", testReadFile(existing), name)
+			assert.NoFileExists(t, filepath.Join(dir, "bye_com.cfg"), name)
+		}
+
+		os.WriteFile(existing, []byte("backend hi.com"), 0644)
+		os.Remove(filepath.Join(dir, "bye_com.cfg"))
+	}
+}
+
+func TestFileBackend_Rollback(t *testing.T) {
+	dir := t.TempDir()
+	limit := 2
+
+	b, err := NewFileBackend(&configuration.LoadBalancer{
+		Template:     "backend {{.Domain}} {{len .Servers}}",
+		ReloadCmd:    "true",
+		ConfigDir:    dir,
+		HistoryLimit: &limit,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		if _, err := b.Apply(&types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Servers: make([]*types.Server, i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	revisions, err := b.history.revisions("hi_com.cfg")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2, 3}, revisions)
+
+	_, err = b.Rollback("hi.com", 1)
+	assert.EqualError(t, err, "revision 1 of hi_com.cfg does not exist")
+
+	restored, err := b.Rollback("hi.com", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, restored)
+	assert.Equal(t, "backend hi.com 2", testReadFile(filepath.Join(dir, "hi_com.cfg")))
+
+	restored, err = b.Rollback("hi.com", 4)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, restored)
+	assert.Equal(t, "backend hi.com 3", testReadFile(filepath.Join(dir, "hi_com.cfg")))
+}
+
+func TestFileBackend_RemoveStale(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "static.cfg"), []byte("frontend http"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &configuration.LoadBalancer{Template: "backend {{.Domain}}", ReloadCmd: "true", ConfigDir: dir}
+
+	previous, err := NewFileBackend(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, domain := range []string{"hi.com", "bye.com"} {
+		if _, err := previous.Apply(&types.LoadBalancerUpstreamDefinition{Domain: domain}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a restarted backend only knows which files it wrote from the manifest
+	b, err := NewFileBackend(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reload, err := b.RemoveStale(types.Set[string]{"hi.com": {}})
+
+	assert.NoError(t, err)
+	assert.True(t, reload)
+	assert.FileExists(t, filepath.Join(dir, "hi_com.cfg"))
+	assert.FileExists(t, filepath.Join(dir, "static.cfg"))
+	assert.NoFileExists(t, filepath.Join(dir, "bye_com.cfg"))
+	assert.Equal(t, "hi.com\n", testReadFile(filepath.Join(dir, managedFileName)))
+
+	reload, err = b.RemoveStale(types.Set[string]{"hi.com": {}})
+
+	assert.NoError(t, err)
+	assert.False(t, reload)
+}
+
+func TestFileBackend_ReloadRestoresManagedDomains(t *testing.T) {
+	dir := t.TempDir()
+
+	b, err := NewFileBackend(&configuration.LoadBalancer{Template: "backend {{.Domain}}", ReloadCmd: "true", ConfigDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, domain := range []string{"hi.com", "bye.com"} {
+		if _, err := b.Apply(&types.LoadBalancerUpstreamDefinition{Domain: domain}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.NoError(t, b.Reload())
+
+	b.validate = template.Must(template.New("validate-cmd").Parse("false"))
+
+	_, err = b.RemoveStale(types.Set[string]{"hi.com": {}})
+	assert.NoError(t, err)
+	assert.Equal(t, "hi.com\n", testReadFile(filepath.Join(dir, managedFileName)))
+
+	var validationErr *ValidationError
+	assert.ErrorAs(t, b.Reload(), &validationErr)
+
+	assert.FileExists(t, filepath.Join(dir, "bye_com.cfg"))
+	assert.Equal(t, "bye.com\nhi.com\n", testReadFile(filepath.Join(dir, managedFileName)))
+	assert.Equal(t, types.Set[string]{"hi.com": {}, "bye.com": {}}, b.managed)
+}
+
+func TestFileBackend_ApplyAggregated(t *testing.T) {
+	dir := t.TempDir()
+
+	b, err := NewFileBackend(&configuration.LoadBalancer{
+		Template:  "frontend http use_backend %[req.hdr(host),lower,map({{.MapFile}})]\n{{range .Upstreams}}backend {{.Domain}} {{len .Servers}}\n{{end}}",
+		ReloadCmd: "true",
+		ConfigDir: dir,
+		Aggregate: &configuration.Aggregate{Enabled: true, File: "balanced.cfg", MapFile: "domains.map", MapBackend: "be_{{.Domain}}"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reload, err := b.Apply(&types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Servers: []*types.Server{{Id: "one"}}})
+	assert.NoError(t, err)
+	assert.True(t, reload)
+
+	reload, err = b.Apply(&types.LoadBalancerUpstreamDefinition{Domain: "bye.com"})
+	assert.NoError(t, err)
+	assert.True(t, reload)
+
+	reload, err = b.Apply(&types.LoadBalancerUpstreamDefinition{Domain: "bye.com"})
+	assert.NoError(t, err)
+	assert.False(t, reload)
+
+	mapFile := filepath.Join(dir, "domains.map")
+	assert.Equal(t, "frontend http use_backend %[req.hdr(host),lower,map("+mapFile+")]\nbackend bye.com 0\nbackend hi.com 1\n", testReadFile(filepath.Join(dir, "balanced.cfg")))
+	assert.Equal(t, "bye.com be_bye.com\nhi.com be_hi.com\n", testReadFile(mapFile))
+
+	reload, err = b.Remove("hi.com")
+	assert.NoError(t, err)
+	assert.True(t, reload)
+	assert.Equal(t, "bye.com be_bye.com\n", testReadFile(mapFile))
+	assert.NoFileExists(t, filepath.Join(dir, "hi_com.cfg"))
+}
+
+func TestFileBackend_ApplyAggregatedHoldsUntilSynced(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "balanced.cfg")
+	if err := os.WriteFile(file, []byte("backend bye.com\nbackend hi.com\nbackend old.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewFileBackend(&configuration.LoadBalancer{
+		Template:  "{{range .Upstreams}}backend {{.Domain}}\n{{end}}",
+		ReloadCmd: "true",
+		ConfigDir: dir,
+		Aggregate: &configuration.Aggregate{Enabled: true, File: "balanced.cfg", MapBackend: "{{.Domain}}"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reload, err := b.RemoveStale(types.Set[string]{"hi.com": {}, "bye.com": {}, "gone.com": {}})
+	assert.NoError(t, err)
+	assert.False(t, reload)
+
+	reload, err = b.Apply(&types.LoadBalancerUpstreamDefinition{Domain: "hi.com"})
+	assert.NoError(t, err)
+	assert.False(t, reload)
+
+	reload, err = b.Remove("gone.com")
+	assert.NoError(t, err)
+	assert.False(t, reload)
+	assert.Equal(t, "backend bye.com\nbackend hi.com\nbackend old.com\n", testReadFile(file), "the previous file should be kept until every domain is applied")
+
+	reload, err = b.Apply(&types.LoadBalancerUpstreamDefinition{Domain: "bye.com"})
+	assert.NoError(t, err)
+	assert.True(t, reload)
+	assert.Equal(t, "backend bye.com\nbackend hi.com\n", testReadFile(file))
+
+	// without waiting for it, the file is written once domains have not been applied in time
+	_, err = b.RemoveStale(types.Set[string]{"hi.com": {}, "bye.com": {}, "new.com": {}, "late.com": {}})
+	assert.NoError(t, err)
+	b.waitingUntil = time.Now().Add(-time.Second)
+
+	reload, err = b.Apply(&types.LoadBalancerUpstreamDefinition{Domain: "new.com"})
+	assert.NoError(t, err)
+	assert.True(t, reload)
+	assert.Equal(t, "backend bye.com\nbackend hi.com\nbackend new.com\n", testReadFile(file))
+}
+
+func TestOnlyServersChanged(t *testing.T) {
+	servers := []*types.Server{{Id: "one", IPAddress: "10.1.1.1", Port: 80}}
+
+	tests := map[string]struct {
+		last     *types.LoadBalancerUpstreamDefinition
+		change   *types.LoadBalancerUpstreamDefinition
+		expected bool
+	}{
+		"false without a previous definition": {
+			nil,
+			&types.LoadBalancerUpstreamDefinition{Domain: "hi.com"},
+			false,
+		},
+		"true when only servers changed": {
+			&types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Annotations: map[string]string{"balance": "leastconn"}},
+			&types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Annotations: map[string]string{"balance": "leastconn"}, Servers: servers},
+			true,
+		},
+		"false when annotations changed": {
+			&types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Annotations: map[string]string{"balance": "leastconn"}, Servers: servers},
+			&types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Annotations: map[string]string{"balance": "roundrobin"}, Servers: servers},
+			false,
+		},
+	}
+
+	for name, test := range tests {
+		assert.Equal(t, test.expected, onlyServersChanged(test.last, test.change), name)
+	}
+}
+
+func TestBackupsChanged(t *testing.T) {
+	def := func(servers ...*types.Server) *types.LoadBalancerUpstreamDefinition {
+		return &types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Servers: servers}
+	}
+
+	tests := map[string]struct {
+		last     *types.LoadBalancerUpstreamDefinition
+		change   *types.LoadBalancerUpstreamDefinition
+		expected bool
+	}{
+		"false when backups are unchanged": {
+			def(&types.Server{IPAddress: "10.1.1.1", Port: 80, Backup: true}),
+			def(&types.Server{IPAddress: "10.1.1.1", Port: 80, Backup: true}, &types.Server{IPAddress: "10.1.1.2", Port: 80}),
+			false,
+		},
+		"false when a new server is a backup": {
+			def(&types.Server{IPAddress: "10.1.1.1", Port: 80}),
+			def(&types.Server{IPAddress: "10.1.1.2", Port: 80, Backup: true}),
+			false,
+		},
+		"true when a server became a backup": {
+			def(&types.Server{IPAddress: "10.1.1.1", Port: 80}),
+			def(&types.Server{IPAddress: "10.1.1.1", Port: 80, Backup: true}),
+			true,
+		},
+	}
+
+	for name, test := range tests {
+		assert.Equal(t, test.expected, backupsChanged(test.last, test.change), name)
+	}
+}
+
+func TestFileBackend_AppliedOnlyOnceWritten(t *testing.T) {
+	dir := t.TempDir()
+
+	b, err := NewFileBackend(&configuration.LoadBalancer{Template: "backend {{.Domain}} {{.Annotations.balance}}", ReloadCmd: "true", ConfigDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := &types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Annotations: map[string]string{"balance": "roundrobin"}}
+	_, err = b.Apply(first)
+	assert.NoError(t, err)
+	assert.NoError(t, b.Reload())
+
+	second := &types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Annotations: map[string]string{"balance": "leastconn"}}
+
+	b.cfg.ConfigDir = filepath.Join(dir, "missing")
+	_, err = b.Apply(second)
+	assert.Error(t, err)
+	assert.Same(t, first, b.applied["hi.com"], "a change which was not written should not be recorded")
+
+	b.cfg.ConfigDir = dir
+	b.validate = template.Must(template.New("validate-cmd").Parse("false"))
+	_, err = b.Apply(second)
+	assert.NoError(t, err)
+	assert.Same(t, second, b.applied["hi.com"])
+
+	assert.Error(t, b.Reload())
+	assert.NotContains(t, b.applied, "hi.com", "a restored domain should not be recorded")
+}
+
+func TestFileBackend_ApplyAnnotations(t *testing.T) {
+	dir := t.TempDir()
+
+	b, err := NewFileBackend(&configuration.LoadBalancer{
+		Template:  `backend {{.Domain}} balance {{.Annotations.balance | default "roundrobin"}}`,
+		ReloadCmd: "true",
+		ConfigDir: dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reload, err := b.Apply(&types.LoadBalancerUpstreamDefinition{Domain: "hi.com"})
+	assert.NoError(t, err)
+	assert.True(t, reload)
+	assert.Equal(t, "backend hi.com balance roundrobin", testReadFile(filepath.Join(dir, "hi_com.cfg")))
+
+	reload, err = b.Apply(&types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Annotations: map[string]string{"balance": "leastconn"}})
+	assert.NoError(t, err)
+	assert.True(t, reload)
+	assert.Equal(t, "backend hi.com balance leastconn", testReadFile(filepath.Join(dir, "hi_com.cfg")))
+}
@@ -0,0 +1,154 @@
+package loadbalancer
+
+import (
+	"balanced/pkg/types"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// weights given by the weight helper to servers inside and outside of the preferred zone
+const (
+	preferredZoneWeight = 100
+	otherZoneWeight     = 1
+)
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// Funcs returns the helper functions available to every template:
+//
+//	sanitize "hi.com"              hi_com, any character other than letters, digits, - and _ replaced by _
+//	default "x" .Value             .Value unless it is empty, otherwise "x"
+//	join "," .List                 the elements of .List separated by ","
+//	toJson .Value                  .Value encoded as JSON
+//	sha256 "text"                  hex encoded sha256 digest of "text"
+//	env "NAME"                     value of the environment variable NAME
+//	sortBy "IPAddress" .Servers    copy of .Servers sorted by the given field
+//	weight . "eu-west-1a"          weight of a server, its Weight when annotated on its pod, otherwise 100
+//	                               inside the given zone and 1 outside of it, servers without a zone are
+//	                               treated as inside
+func Funcs() template.FuncMap {
+	return template.FuncMap{
+		"sanitize": sanitize,
+		"default":  defaultValue,
+		"join":     join,
+		"toJson":   toJSON,
+		"sha256":   sha256Hex,
+		"env":      os.Getenv,
+		"sortBy":   sortBy,
+		"weight":   weight,
+	}
+}
+
+func sanitize(name string) string {
+	return unsafeNameChars.ReplaceAllString(name, "_")
+}
+
+func defaultValue(def, value interface{}) interface{} {
+	if value == nil {
+		return def
+	}
+
+	if v := reflect.ValueOf(value); v.IsZero() || ((v.Kind() == reflect.Slice || v.Kind() == reflect.Map) && v.Len() == 0) {
+		return def
+	}
+
+	return value
+}
+
+func join(sep string, list interface{}) (string, error) {
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return "", fmt.Errorf("join: expected a list, got %T", list)
+	}
+
+	parts := make([]string, v.Len())
+	for i := range parts {
+		parts[i] = fmt.Sprint(v.Index(i).Interface())
+	}
+
+	return strings.Join(parts, sep), nil
+}
+
+func toJSON(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+func sha256Hex(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// sortBy returns a copy of list, a slice of structs or pointers to structs, stably sorted by field.
+func sortBy(field string, list interface{}) (interface{}, error) {
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("sortBy: expected a list, got %T", list)
+	}
+
+	keys := make([]reflect.Value, v.Len())
+	for i := range keys {
+		elem := reflect.Indirect(v.Index(i))
+		if elem.Kind() != reflect.Struct {
+			return nil, fmt.Errorf("sortBy: expected a list of structs, got %s", elem.Type())
+		}
+
+		keys[i] = elem.FieldByName(field)
+		if !keys[i].IsValid() {
+			return nil, fmt.Errorf("sortBy: %s has no field %s", elem.Type(), field)
+		}
+	}
+
+	order := make([]int, v.Len())
+	for i := range order {
+		order[i] = i
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		return lessValue(keys[order[i]], keys[order[j]])
+	})
+
+	sorted := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+	for i, idx := range order {
+		sorted.Index(i).Set(v.Index(idx))
+	}
+
+	return sorted.Interface(), nil
+}
+
+func lessValue(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() < b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return a.Uint() < b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() < b.Float()
+	default:
+		return fmt.Sprint(a.Interface()) < fmt.Sprint(b.Interface())
+	}
+}
+
+func weight(srv *types.Server, zone string) int {
+	if srv.Weight != nil {
+		return *srv.Weight
+	}
+
+	if zone == "" || srv.Meta == nil || srv.Meta.Zone == "" || srv.Meta.Zone == zone {
+		return preferredZoneWeight
+	}
+
+	return otherZoneWeight
+}
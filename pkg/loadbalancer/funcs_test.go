@@ -0,0 +1,118 @@
+package loadbalancer
+
+import (
+	"balanced/pkg/types"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFuncs(t *testing.T) {
+	t.Setenv("BALANCED_TEST_ENV", "from-env")
+
+	data := map[string]interface{}{
+		"Domain": "hi.example.com",
+		"Empty":  "",
+		"List":   []int32{80, 443},
+		"Servers": []*types.Server{
+			{Id: "two", IPAddress: "10.1.1.2", Port: 8080, Meta: &types.ServerMeta{Zone: "eu-west-1b"}},
+			{Id: "one", IPAddress: "10.1.1.1", Port: 80, Meta: &types.ServerMeta{Zone: "eu-west-1a"}},
+			{Id: "three", IPAddress: "10.1.1.3", Port: 443},
+		},
+	}
+
+	tests := map[string]struct {
+		template string
+		expected string
+	}{
+		"sanitize":           {`{{sanitize .Domain}}`, "hi_example_com"},
+		"default when empty": {`{{default "/" .Empty}}`, "/"},
+		"default when set":   {`{{default "none" .Domain}}`, "hi.example.com"},
+		"join":               {`{{join "," .List}}`, "80,443"},
+		"toJson":             {`{{toJson .List}}`, "[80,443]"},
+		"sha256":             {`{{sha256 "hi"}}`, "8f434346648f6b96df89dda901c5176b10a6d83961dd3c1ac88b59b2dc327aa4"},
+		"env":                {`{{env "BALANCED_TEST_ENV"}}`, "from-env"},
+		"sortBy string":      {`{{range sortBy "IPAddress" .Servers}}{{.Id}} {{end}}`, "one two three "},
+		"sortBy number":      {`{{range sortBy "Port" .Servers}}{{.Port}} {{end}}`, "80 443 8080 "},
+		"weight":             {`{{range .Servers}}{{weight . "eu-west-1a"}} {{end}}`, "1 100 100 "},
+	}
+
+	for name, test := range tests {
+		tmpl, err := template.New(name).Funcs(Funcs()).Parse(test.template)
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+
+		b := new(strings.Builder)
+		assert.NoError(t, tmpl.Execute(b, data), name)
+		assert.Equal(t, test.expected, b.String(), name)
+	}
+
+	annotated := 25
+	assert.Equal(t, 25, weight(&types.Server{Weight: &annotated, Meta: &types.ServerMeta{Zone: "eu-west-1b"}}, "eu-west-1a"))
+
+	_, err := sortBy("Missing", data["Servers"])
+	assert.EqualError(t, err, "sortBy: types.Server has no field Missing")
+}
+
+func TestNewRenderer_TemplateDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "servers.tmpl"), []byte(`{{define "servers"}}{{range .}}  server {{.Id}} {{.IPAddress}}:{{.Port}}
+{{end}}{{end}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewRenderer("backend {{sanitize .Domain}}\n{{template \"servers\" .Servers}}", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := new(strings.Builder)
+	err = r.ToWriter(b, &types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Servers: []*types.Server{{Id: "one", IPAddress: "10.1.1.1", Port: 80}}})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "backend hi_com\n  server one 10.1.1.1:80\n", b.String())
+
+	_, err = NewRenderer("", filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestRenderer_ToWriterNamedTemplate(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "tcp.tmpl"), []byte(`{{define "tcp-check"}}  option tcp-check{{end}}backend {{.Domain}}
+  mode tcp`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewRenderer(`{{define "slow"}}backend {{.Domain}}
+  timeout server 5m{{end}}backend {{.Domain}}`, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		template    string
+		expected    string
+		expectedErr error
+	}{
+		"renders configured template by default": {"", "backend hi.com", nil},
+		"renders file by name":                   {"tcp", "backend hi.com\n  mode tcp", nil},
+		"renders file by file name":              {"tcp.tmpl", "backend hi.com\n  mode tcp", nil},
+		"returns error for unknown template":     {"udp", "", &TemplateNotFoundError{Name: "udp"}},
+		"returns error for defined template":     {"slow", "", &TemplateNotFoundError{Name: "slow"}},
+		"returns error for template within file": {"tcp-check", "", &TemplateNotFoundError{Name: "tcp-check"}},
+		"returns error for configured template":  {"balanced", "", &TemplateNotFoundError{Name: "balanced"}},
+	}
+
+	for name, test := range tests {
+		b := new(strings.Builder)
+		err := r.ToWriter(b, &types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Template: test.template})
+
+		assert.Equal(t, test.expectedErr, err, name)
+		assert.Equal(t, test.expected, b.String(), name)
+	}
+}
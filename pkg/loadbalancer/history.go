@@ -0,0 +1,151 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// historyDirName is the directory within config-dir previous revisions of the configuration files are kept in
+const historyDirName = ".history"
+
+// history keeps up to limit previous revisions of each configuration file, named after the file
+// with an increasing revision number appended, e.g. hi_com.cfg.3.
+type history struct {
+	dir   string
+	limit int
+}
+
+// save stores data as the next revision of filename, pruning the oldest revisions beyond the limit.
+func (h *history) save(filename string, data []byte) (int, error) {
+	if h == nil || h.limit <= 0 {
+		return 0, nil
+	}
+
+	if err := os.MkdirAll(h.dir, 0755); err != nil {
+		return 0, fmt.Errorf("unable to create history directory %s: %s", h.dir, err)
+	}
+
+	revisions, err := h.revisions(filename)
+	if err != nil {
+		return 0, err
+	}
+
+	next := 1
+	if len(revisions) > 0 {
+		next = revisions[len(revisions)-1] + 1
+	}
+
+	if err := tryWriteToFile(h.path(filename, next), data); err != nil {
+		return 0, err
+	}
+
+	revisions = append(revisions, next)
+	for len(revisions) > h.limit {
+		if err := os.Remove(h.path(filename, revisions[0])); err != nil && !os.IsNotExist(err) {
+			return next, fmt.Errorf("unable to prune revision %d of %s: %s", revisions[0], filename, err)
+		}
+		revisions = revisions[1:]
+	}
+
+	return next, nil
+}
+
+// revisions lists the revisions kept of filename, oldest first.
+func (h *history) revisions(filename string) ([]int, error) {
+	if h == nil {
+		return nil, nil
+	}
+
+	matches, err := filepath.Glob(filepath.Join(h.dir, filename+".*"))
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := make([]int, 0, len(matches))
+	for _, m := range matches {
+		rev, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(m), filename+"."))
+		if err != nil {
+			continue
+		}
+		revisions = append(revisions, rev)
+	}
+	sort.Ints(revisions)
+
+	return revisions, nil
+}
+
+func (h *history) read(filename string, revision int) ([]byte, error) {
+	if h == nil {
+		return nil, fmt.Errorf("no history is kept of %s", filename)
+	}
+
+	data, err := os.ReadFile(h.path(filename, revision))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("revision %d of %s does not exist", revision, filename)
+		}
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (h *history) path(filename string, revision int) string {
+	return filepath.Join(h.dir, fmt.Sprintf("%s.%d", filename, revision))
+}
+
+// writeFileAtomic writes to a temporary file in the same directory as path, syncs it and renames
+// it over path, so path holds either its previous or its new contents even after a crash.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	dir := filepath.Dir(path)
+
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		// the name of the temporary file is random, so only the cause is reported
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			err = pathErr.Err
+		}
+		return fmt.Errorf("unable to open %s: %s", path, err)
+	}
+
+	tmpPath := f.Name()
+	defer os.Remove(tmpPath)
+
+	if err := write(f); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write to file %s: %s", path, err)
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to sync %s: %s", path, err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("unable to close %s: %s", path, err)
+	}
+
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("unable to replace %s: %s", path, err)
+	}
+
+	// the rename itself is only durable once the directory is synced
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
@@ -2,23 +2,78 @@ package loadbalancer
 
 import (
 	"balanced/pkg/types"
+	"fmt"
 	"io"
+	"path/filepath"
+	"strings"
 	"text/template"
 )
 
 type Renderer struct {
 	t *template.Template
+	// names of the files parsed from template-dir, the only templates a definition can name
+	files map[string]string
 }
 
+// TemplateNotFoundError is returned when a definition names a template which is not defined.
+type TemplateNotFoundError struct {
+	Name string
+}
+
+func (e *TemplateNotFoundError) Error() string {
+	return fmt.Sprintf("template %q is not defined in template-dir", e.Name)
+}
+
+// ToWriter renders obj with the template file it names, with or without the .tmpl extension, or the
+// configured template when it names none. Templates {{define}}d within the files cannot be named.
 func (r *Renderer) ToWriter(w io.Writer, obj *types.LoadBalancerUpstreamDefinition) error {
-	return r.t.Execute(w, obj)
+	if obj.Template == "" {
+		return r.t.Execute(w, obj)
+	}
+
+	name, exists := r.files[obj.Template]
+	if !exists {
+		return &TemplateNotFoundError{Name: obj.Template}
+	}
+
+	return r.t.ExecuteTemplate(w, name, obj)
 }
 
-func NewRenderer(templateText string) (*Renderer, error) {
-	t, err := template.New("balanced").Parse(templateText)
-	if err != nil {
+// Upstreams is what the template is rendered with when aggregate is enabled.
+type Upstreams struct {
+	// every definition, sorted by domain
+	Upstreams []*types.LoadBalancerUpstreamDefinition
+	// path of the generated map file of domain to backend, empty unless map-file is set
+	MapFile string
+}
+
+func (r *Renderer) ToWriterAll(w io.Writer, upstreams *Upstreams) error {
+	return r.t.Execute(w, upstreams)
+}
+
+// NewRenderer parses templateText with the helper functions of Funcs. When templateDir is set, every
+// *.tmpl file in it is parsed as well, so the templates they define can be used with {{template}}.
+func NewRenderer(templateText, templateDir string) (*Renderer, error) {
+	t := template.New("balanced").Funcs(Funcs())
+	files := make(map[string]string)
+
+	if templateDir != "" {
+		if _, err := t.ParseGlob(filepath.Join(templateDir, "*.tmpl")); err != nil {
+			return nil, fmt.Errorf("loadbalancer.template-dir: %s", err)
+		}
+
+		// ParseGlob has already read the directory, so this only fails for a malformed pattern
+		matches, _ := filepath.Glob(filepath.Join(templateDir, "*.tmpl"))
+		for _, match := range matches {
+			name := filepath.Base(match)
+			files[name] = name
+			files[strings.TrimSuffix(name, ".tmpl")] = name
+		}
+	}
+
+	if _, err := t.Parse(templateText); err != nil {
 		return nil, err
 	}
 
-	return &Renderer{t: t}, nil
+	return &Renderer{t: t, files: files}, nil
 }
@@ -0,0 +1,390 @@
+package loadbalancer
+
+import (
+	"balanced/pkg/configuration"
+	"balanced/pkg/types"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errReloadRequired is returned when a change cannot be applied through the runtime API and
+// the rewritten configuration file has to be loaded with a reload instead.
+var errReloadRequired = errors.New("reload required")
+
+// admin state flags of a server which is in maintenance, see srv_admin_state in the HAProxy management guide
+const serverAdminMaintMask = 0x01 | 0x02 | 0x04 | 0x20 | 0x40
+
+// RuntimeAPI applies server changes to a running HAProxy through its stats socket, so that
+// endpoint churn does not require a reload.
+type RuntimeAPI struct {
+	network       string
+	address       string
+	timeout       time.Duration
+	backend       *template.Template
+	serverOptions string
+
+	// servers added with "add server", which are deleted rather than kept as free slots when stale
+	added map[string]types.Set[string]
+	mx    *sync.Mutex
+}
+
+type runtimeServer struct {
+	name       string
+	address    string
+	port       string
+	adminState int
+	// current and initial weight, -1 when not reported
+	weight        int
+	initialWeight int
+}
+
+func (s *runtimeServer) inMaintenance() bool {
+	return s.adminState&serverAdminMaintMask != 0
+}
+
+func (s *runtimeServer) endpoint() string {
+	return net.JoinHostPort(s.address, s.port)
+}
+
+// Apply brings the servers of the domain's backend in line with def. Servers which are already
+// present are enabled, stale servers are disabled and their slots reused for new servers, and
+// "add server" is used once no free slot is left, which is also how new backup servers are added
+// as slots cannot be turned into backups. Weights are set to the server's Weight, or reset to the
+// configured weight when it has none. errReloadRequired is returned when the backend does not
+// exist yet or no more servers can be added.
+func (r *RuntimeAPI) Apply(def *types.LoadBalancerUpstreamDefinition) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	backend, err := r.backendName(def)
+	if err != nil {
+		return err
+	}
+
+	current, err := r.servers(backend)
+	if err != nil {
+		return err
+	}
+
+	byEndpoint := make(map[string]*runtimeServer)
+	for _, s := range current {
+		byEndpoint[s.endpoint()] = s
+	}
+
+	keep := make(types.Set[string])
+	pending := make([]*types.Server, 0)
+
+	for _, srv := range def.Servers {
+		s, exists := byEndpoint[net.JoinHostPort(srv.IPAddress, strconv.Itoa(int(srv.Port)))]
+		if !exists || keep.Has(s.name) {
+			pending = append(pending, srv)
+			continue
+		}
+
+		keep.Add(s.name)
+		if err := r.setWeight(backend, s, srv); err != nil {
+			return err
+		}
+
+		if s.inMaintenance() {
+			if err := r.enable(backend, s.name); err != nil {
+				return err
+			}
+		}
+	}
+
+	free := make([]*runtimeServer, 0)
+	for _, s := range current {
+		if keep.Has(s.name) {
+			continue
+		}
+
+		if !s.inMaintenance() {
+			if err := r.disable(backend, s.name); err != nil {
+				return err
+			}
+		}
+
+		free = append(free, s)
+	}
+
+	for _, srv := range pending {
+		if len(free) > 0 && !srv.Backup {
+			slot := free[0]
+			free = free[1:]
+
+			if err := r.setAddress(backend, slot.name, srv); err != nil {
+				return err
+			}
+
+			if err := r.setWeight(backend, slot, srv); err != nil {
+				return err
+			}
+
+			if err := r.enable(backend, slot.name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := r.addServer(backend, srv); err != nil {
+			return err
+		}
+	}
+
+	for _, s := range free {
+		if r.added[backend].Has(s.name) {
+			r.deleteServer(backend, s.name)
+		}
+	}
+
+	return nil
+}
+
+func (r *RuntimeAPI) backendName(def *types.LoadBalancerUpstreamDefinition) (string, error) {
+	b := new(strings.Builder)
+	if err := r.backend.Execute(b, def); err != nil {
+		return "", fmt.Errorf("unable to render backend name for %s: %s", def.Domain, err)
+	}
+
+	return b.String(), nil
+}
+
+// servers lists the servers of backend using "show servers state".
+func (r *RuntimeAPI) servers(backend string) ([]*runtimeServer, error) {
+	resp, err := r.command("show servers state " + backend)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(resp, "Can't find backend") {
+		return nil, fmt.Errorf("backend %s does not exist: %w", backend, errReloadRequired)
+	}
+
+	return parseServersState(resp)
+}
+
+func (r *RuntimeAPI) enable(backend, server string) error {
+	return r.expectEmpty(fmt.Sprintf("enable server %s/%s", backend, server))
+}
+
+func (r *RuntimeAPI) disable(backend, server string) error {
+	return r.expectEmpty(fmt.Sprintf("disable server %s/%s", backend, server))
+}
+
+// setWeight sets the weight of s to that of srv, or back to its initial weight when srv has none.
+func (r *RuntimeAPI) setWeight(backend string, s *runtimeServer, srv *types.Server) error {
+	weight := s.initialWeight
+	if srv.Weight != nil {
+		weight = *srv.Weight
+	}
+
+	if weight < 0 || weight == s.weight {
+		return nil
+	}
+
+	return r.expectEmpty(fmt.Sprintf("set server %s/%s weight %d", backend, s.name, weight))
+}
+
+func (r *RuntimeAPI) setAddress(backend, server string, srv *types.Server) error {
+	cmd := fmt.Sprintf("set server %s/%s addr %s port %d", backend, server, srv.IPAddress, srv.Port)
+
+	resp, err := r.command(cmd)
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(resp, "IP changed") && !strings.HasPrefix(resp, "no need to change") {
+		return fmt.Errorf("%s: %s", cmd, resp)
+	}
+
+	return nil
+}
+
+// addServer adds srv to backend, returning errReloadRequired when HAProxy refuses, for instance
+// because it does not support dynamic servers.
+func (r *RuntimeAPI) addServer(backend string, srv *types.Server) error {
+	options := r.serverOptions
+	if srv.Weight != nil {
+		options += fmt.Sprintf(" weight %d", *srv.Weight)
+	}
+	if srv.Backup {
+		options += " backup"
+	}
+
+	cmd := strings.TrimSpace(fmt.Sprintf("add server %s/%s %s:%d %s", backend, srv.Id, srv.IPAddress, srv.Port, strings.TrimSpace(options)))
+
+	resp, err := r.command(cmd)
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(resp, "New server registered") {
+		return fmt.Errorf("no free server slot in %s, %s: %s: %w", backend, cmd, resp, errReloadRequired)
+	}
+
+	if _, exists := r.added[backend]; !exists {
+		r.added[backend] = make(types.Set[string])
+	}
+	r.added[backend].Add(srv.Id)
+
+	// dynamic servers are added in maintenance
+	return r.enable(backend, srv.Id)
+}
+
+// deleteServer removes a server added at runtime, leaving it disabled if HAProxy refuses, for
+// instance while it still has connections.
+func (r *RuntimeAPI) deleteServer(backend, server string) {
+	cmd := fmt.Sprintf("del server %s/%s", backend, server)
+
+	resp, err := r.command(cmd)
+	if err != nil || !strings.HasPrefix(resp, "Server deleted") {
+		log.Debugf("%s: %s %v, keeping it disabled", cmd, resp, err)
+		return
+	}
+
+	r.added[backend].Remove(server)
+}
+
+// expectEmpty runs cmd and returns the response as an error, commands which succeed respond with nothing.
+func (r *RuntimeAPI) expectEmpty(cmd string) error {
+	resp, err := r.command(cmd)
+	if err != nil {
+		return err
+	}
+
+	if resp != "" {
+		return fmt.Errorf("%s: %s", cmd, resp)
+	}
+
+	return nil
+}
+
+// command sends a single command over a new connection and returns the trimmed response.
+func (r *RuntimeAPI) command(cmd string) (string, error) {
+	conn, err := net.DialTimeout(r.network, r.address, r.timeout)
+	if err != nil {
+		return "", fmt.Errorf("unable to connect to runtime api %s: %s", r.address, err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(r.timeout)); err != nil {
+		return "", err
+	}
+
+	log.Debugf("runtime api: %s", cmd)
+
+	if _, err := io.WriteString(conn, cmd+"\n"); err != nil {
+		return "", fmt.Errorf("unable to send %q to runtime api: %s", cmd, err)
+	}
+
+	resp, err := io.ReadAll(conn)
+	if err != nil {
+		return "", fmt.Errorf("unable to read response to %q from runtime api: %s", cmd, err)
+	}
+
+	return strings.TrimSpace(string(resp)), nil
+}
+
+// parseServersState reads the output of "show servers state", using the header line to locate columns.
+func parseServersState(resp string) ([]*runtimeServer, error) {
+	servers := make([]*runtimeServer, 0)
+	columns := make(map[string]int)
+
+	scanner := bufio.NewScanner(strings.NewReader(resp))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if strings.HasPrefix(line, "#") {
+			for i, name := range strings.Fields(strings.TrimPrefix(line, "#")) {
+				columns[name] = i
+			}
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(columns) == 0 || len(fields) < len(columns) {
+			continue
+		}
+
+		adminState, err := strconv.Atoi(fields[columns["srv_admin_state"]])
+		if err != nil {
+			return nil, fmt.Errorf("unexpected servers state %q: %s", line, err)
+		}
+
+		servers = append(servers, &runtimeServer{
+			name:          fields[columns["srv_name"]],
+			address:       fields[columns["srv_addr"]],
+			port:          fields[columns["srv_port"]],
+			adminState:    adminState,
+			weight:        optionalInt(fields, columns, "srv_uweight"),
+			initialWeight: optionalInt(fields, columns, "srv_iweight"),
+		})
+	}
+
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("unexpected servers state response: %s", resp)
+	}
+
+	for _, col := range []string{"srv_name", "srv_addr", "srv_port", "srv_admin_state"} {
+		if _, exists := columns[col]; !exists {
+			return nil, fmt.Errorf("servers state response is missing column %s", col)
+		}
+	}
+
+	return servers, nil
+}
+
+// optionalInt reads an integer column, returning -1 when it is missing or not a number.
+func optionalInt(fields []string, columns map[string]int, col string) int {
+	i, exists := columns[col]
+	if !exists {
+		return -1
+	}
+
+	v, err := strconv.Atoi(fields[i])
+	if err != nil {
+		return -1
+	}
+
+	return v
+}
+
+func NewRuntimeAPI(cfg *configuration.RuntimeAPI) (*RuntimeAPI, error) {
+	network, address := "unix", cfg.Address
+	switch {
+	case strings.HasPrefix(cfg.Address, "unix://"):
+		address = strings.TrimPrefix(cfg.Address, "unix://")
+	case strings.HasPrefix(cfg.Address, "tcp://"):
+		network, address = "tcp", strings.TrimPrefix(cfg.Address, "tcp://")
+	}
+
+	if address == "" {
+		return nil, errors.New("loadbalancer.runtime-api: address must be set")
+	}
+
+	backend, err := template.New("backend").Funcs(Funcs()).Parse(cfg.Backend)
+	if err != nil {
+		return nil, fmt.Errorf("loadbalancer.runtime-api: invalid backend: %s", err)
+	}
+
+	return &RuntimeAPI{
+		network:       network,
+		address:       address,
+		timeout:       *cfg.Timeout,
+		backend:       backend,
+		serverOptions: cfg.ServerOptions,
+		added:         make(map[string]types.Set[string]),
+		mx:            &sync.Mutex{},
+	}, nil
+}
@@ -0,0 +1,304 @@
+package loadbalancer
+
+import (
+	"balanced/pkg/configuration"
+	"balanced/pkg/types"
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeServer struct {
+	name   string
+	addr   string
+	port   string
+	maint  bool
+	weight string
+	backup bool
+}
+
+// currentWeight returns the weight of the server, 1 as in HAProxy unless set.
+func (s *fakeServer) currentWeight() string {
+	if s.weight == "" {
+		return "1"
+	}
+
+	return s.weight
+}
+
+// fakeHAProxy answers the subset of runtime api commands used by RuntimeAPI from in-memory backends.
+type fakeHAProxy struct {
+	mx              sync.Mutex
+	backends        map[string][]*fakeServer
+	dynamicDisabled bool
+	commands        []string
+}
+
+func (f *fakeHAProxy) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		conn.Write([]byte(f.handle(strings.TrimSpace(line)) + "\n"))
+		conn.Close()
+	}
+}
+
+func (f *fakeHAProxy) handle(cmd string) string {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	f.commands = append(f.commands, cmd)
+	args := strings.Fields(cmd)
+
+	if strings.HasPrefix(cmd, "show servers state ") {
+		servers, exists := f.backends[args[3]]
+		if !exists {
+			return "Can't find backend."
+		}
+
+		b := new(strings.Builder)
+		b.WriteString("1\n# be_id be_name srv_id srv_name srv_addr srv_op_state srv_admin_state srv_uweight srv_iweight srv_time_since_last_change srv_check_status srv_check_result srv_check_health srv_check_state srv_agent_state bk_f_forced_id srv_f_forced_id srv_fqdn srv_port srvrecord\n")
+		for i, s := range servers {
+			admin := 0
+			if s.maint {
+				admin = 1
+			}
+			fmt.Fprintf(b, "3 %s %d %s %s 2 %d %s 1 10 6 3 4 6 0 0 0 - %s -\n", args[3], i+1, s.name, s.addr, admin, s.currentWeight(), s.port)
+		}
+		return b.String()
+	}
+
+	if args[0] == "add" {
+		if f.dynamicDisabled {
+			return "Unknown command."
+		}
+
+		backend, name := f.split(args[2])
+		host, port, _ := net.SplitHostPort(args[3])
+		srv := &fakeServer{name: name, addr: host, port: port, maint: true}
+		for i, arg := range args {
+			switch arg {
+			case "weight":
+				srv.weight = args[i+1]
+			case "backup":
+				srv.backup = true
+			}
+		}
+		f.backends[backend] = append(f.backends[backend], srv)
+		return "New server registered."
+	}
+
+	backend, name := f.split(args[2])
+	var srv *fakeServer
+	for _, s := range f.backends[backend] {
+		if s.name == name {
+			srv = s
+		}
+	}
+
+	if srv == nil {
+		return "No such server."
+	}
+
+	switch args[0] {
+	case "enable":
+		srv.maint = false
+	case "disable":
+		srv.maint = true
+	case "set":
+		if args[3] == "weight" {
+			srv.weight = args[4]
+			return ""
+		}
+		srv.addr, srv.port = args[4], args[6]
+		return "IP changed from '...' to '" + srv.addr + "'"
+	case "del":
+		servers := make([]*fakeServer, 0)
+		for _, s := range f.backends[backend] {
+			if s != srv {
+				servers = append(servers, s)
+			}
+		}
+		f.backends[backend] = servers
+		return "Server deleted."
+	}
+
+	return ""
+}
+
+func (f *fakeHAProxy) split(ref string) (string, string) {
+	parts := strings.SplitN(ref, "/", 2)
+	return parts[0], parts[1]
+}
+
+// active returns the address of every server which is not in maintenance.
+func (f *fakeHAProxy) active(backend string) []string {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	active := make([]string, 0)
+	for _, s := range f.backends[backend] {
+		if !s.maint {
+			active = append(active, net.JoinHostPort(s.addr, s.port))
+		}
+	}
+	sort.Strings(active)
+
+	return active
+}
+
+func newTestRuntimeAPI(t *testing.T, f *fakeHAProxy) *RuntimeAPI {
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go f.serve(l)
+
+	timeout := time.Second
+	r, err := NewRuntimeAPI(&configuration.RuntimeAPI{Address: "unix://" + socket, Backend: "{{.Domain}}", ServerOptions: "check", Timeout: &timeout})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+func TestRuntimeAPI_Apply(t *testing.T) {
+	slots := func() []*fakeServer {
+		return []*fakeServer{
+			{name: "srv1", addr: "10.1.1.1", port: "80"},
+			{name: "srv2", addr: "10.1.1.2", port: "80"},
+			{name: "srv3", addr: "0.0.0.0", port: "0", maint: true},
+		}
+	}
+
+	tests := map[string]struct {
+		backends        map[string][]*fakeServer
+		dynamicDisabled bool
+		servers         []*types.Server
+		expectedErr     error
+		expectedActive  []string
+	}{
+		"returns reload required when the backend does not exist": {
+			map[string][]*fakeServer{},
+			false,
+			[]*types.Server{{Id: "a", IPAddress: "10.1.1.1", Port: 80}},
+			errReloadRequired,
+			[]string{},
+		},
+		"disables servers which are no longer ready": {
+			map[string][]*fakeServer{"hi.com": slots()},
+			false,
+			[]*types.Server{{Id: "a", IPAddress: "10.1.1.1", Port: 80}},
+			nil,
+			[]string{"10.1.1.1:80"},
+		},
+		"reuses free slots for new servers": {
+			map[string][]*fakeServer{"hi.com": slots()},
+			false,
+			[]*types.Server{{Id: "b", IPAddress: "10.1.1.2", Port: 80}, {Id: "c", IPAddress: "10.1.1.3", Port: 80}, {Id: "d", IPAddress: "10.1.1.4", Port: 80}},
+			nil,
+			[]string{"10.1.1.2:80", "10.1.1.3:80", "10.1.1.4:80"},
+		},
+		"adds servers once every slot is in use": {
+			map[string][]*fakeServer{"hi.com": slots()},
+			false,
+			[]*types.Server{{Id: "a", IPAddress: "10.1.1.1", Port: 80}, {Id: "b", IPAddress: "10.1.1.2", Port: 80}, {Id: "c", IPAddress: "10.1.1.3", Port: 80}, {Id: "d", IPAddress: "10.1.1.4", Port: 80}},
+			nil,
+			[]string{"10.1.1.1:80", "10.1.1.2:80", "10.1.1.3:80", "10.1.1.4:80"},
+		},
+		"returns reload required when slots are exhausted and servers cannot be added": {
+			map[string][]*fakeServer{"hi.com": slots()},
+			true,
+			[]*types.Server{{Id: "a", IPAddress: "10.1.1.1", Port: 80}, {Id: "b", IPAddress: "10.1.1.2", Port: 80}, {Id: "c", IPAddress: "10.1.1.3", Port: 80}, {Id: "d", IPAddress: "10.1.1.4", Port: 80}},
+			errReloadRequired,
+			[]string{"10.1.1.1:80", "10.1.1.2:80", "10.1.1.3:80"},
+		},
+	}
+
+	for name, test := range tests {
+		f := &fakeHAProxy{backends: test.backends, dynamicDisabled: test.dynamicDisabled}
+		r := newTestRuntimeAPI(t, f)
+
+		err := r.Apply(&types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Servers: test.servers})
+
+		assert.True(t, errors.Is(err, test.expectedErr), "%s: %v", name, err)
+		assert.Equal(t, test.expectedActive, f.active("hi.com"), name)
+	}
+}
+
+func TestRuntimeAPI_ApplyDeletesStaleAddedServers(t *testing.T) {
+	f := &fakeHAProxy{backends: map[string][]*fakeServer{"hi.com": {{name: "srv1", addr: "10.1.1.1", port: "80"}}}}
+	r := newTestRuntimeAPI(t, f)
+
+	err := r.Apply(&types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Servers: []*types.Server{{Id: "a", IPAddress: "10.1.1.1", Port: 80}, {Id: "b", IPAddress: "10.1.1.2", Port: 80}}})
+	assert.Nil(t, err)
+	assert.Contains(t, f.commands, "add server hi.com/b 10.1.1.2:80 check")
+
+	err = r.Apply(&types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Servers: []*types.Server{{Id: "a", IPAddress: "10.1.1.1", Port: 80}}})
+	assert.Nil(t, err)
+	assert.Contains(t, f.commands, "del server hi.com/b")
+	assert.Len(t, f.backends["hi.com"], 1)
+}
+
+func TestParseServersState(t *testing.T) {
+	resp := "1\n# be_id be_name srv_id srv_name srv_addr srv_op_state srv_admin_state srv_uweight srv_iweight srv_time_since_last_change srv_check_status srv_check_result srv_check_health srv_check_state srv_agent_state bk_f_forced_id srv_f_forced_id srv_fqdn srv_port srvrecord srv_use_ssl\n" +
+		"3 hi.com 1 srv1 10.1.1.1 2 0 1 1 120 6 3 4 6 0 0 0 - 8443 - 1\n" +
+		"3 hi.com 2 srv2 0.0.0.0 0 5 1 1 120 1 0 0 14 0 0 0 - 0 - 0\n"
+
+	servers, err := parseServersState(resp)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []*runtimeServer{
+		{name: "srv1", address: "10.1.1.1", port: "8443", adminState: 0, weight: 1, initialWeight: 1},
+		{name: "srv2", address: "0.0.0.0", port: "0", adminState: 5, weight: 1, initialWeight: 1},
+	}, servers)
+	assert.False(t, servers[0].inMaintenance())
+	assert.True(t, servers[1].inMaintenance())
+
+	_, err = parseServersState("Unknown command.")
+	assert.NotNil(t, err)
+}
+
+func TestRuntimeAPI_ApplyWeights(t *testing.T) {
+	canary, half := 10, 50
+
+	f := &fakeHAProxy{backends: map[string][]*fakeServer{"hi.com": {
+		{name: "srv1", addr: "10.1.1.1", port: "80"},
+		{name: "srv2", addr: "10.1.1.2", port: "80", weight: "20"},
+		{name: "srv3", addr: "0.0.0.0", port: "0", maint: true},
+	}}}
+	r := newTestRuntimeAPI(t, f)
+
+	err := r.Apply(&types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Servers: []*types.Server{
+		{Id: "a", IPAddress: "10.1.1.1", Port: 80},
+		{Id: "b", IPAddress: "10.1.1.2", Port: 80},
+		{Id: "c", IPAddress: "10.1.1.3", Port: 80, Weight: &canary},
+		{Id: "d", IPAddress: "10.1.1.4", Port: 80, Weight: &half, Backup: true},
+	}})
+
+	assert.Nil(t, err)
+	assert.NotContains(t, f.commands, "set server hi.com/srv1 weight 1")
+	assert.Contains(t, f.commands, "set server hi.com/srv2 weight 1")
+	assert.Contains(t, f.commands, "set server hi.com/srv3 weight 10")
+	assert.Contains(t, f.commands, "add server hi.com/d 10.1.1.4:80 check weight 50 backup")
+	assert.Equal(t, "10", f.backends["hi.com"][2].weight)
+	assert.True(t, f.backends["hi.com"][3].backup)
+}
@@ -1,100 +1,204 @@
 package loadbalancer
 
 import (
+	"balanced/pkg/address"
 	"balanced/pkg/configuration"
 	"balanced/pkg/dns"
+	"balanced/pkg/queue"
 	"balanced/pkg/types"
+	"context"
+	"errors"
 	"fmt"
-	"os"
-	"os/exec"
-	"path/filepath"
-	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/google/shlex"
 	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
 )
 
 const (
-	retryAttempts = 3
+	dnsReconcileInterval = time.Minute * 5
 )
 
-func NewUpdater(cfg *configuration.Config) (*Updater, error) {
-	r, err := NewRenderer(cfg.LoadBalancer.Template)
+func NewUpdater(cfg *configuration.Config, opts ...UpdaterOptions) (*Updater, error) {
+	backend, err := NewBackend(cfg.LoadBalancer)
 	if err != nil {
 		return nil, err
 	}
 
-	reg, err := dns.NewCommandRegistrar(&cfg.DNS)
+	if err := backend.Validate(); err != nil {
+		return nil, err
+	}
+
+	switch cfg.LoadBalancer.EmptyUpstreamPolicy {
+	case configuration.EmptyUpstreamKeep, configuration.EmptyUpstreamEmpty, configuration.EmptyUpstreamRemove:
+	default:
+		return nil, fmt.Errorf("loadbalancer.empty-upstream-policy: unsupported policy %q", cfg.LoadBalancer.EmptyUpstreamPolicy)
+	}
+
+	u := &Updater{
+		cfg:     cfg,
+		backend: backend,
+		cache:   make(map[string]*types.LoadBalancerUpstreamDefinition),
+	}
+
+	if cfg.DNS.UsePublicAddress {
+		w, err := address.NewWatcher(cfg.DNS.AddressDiscovery)
+		if err != nil {
+			return nil, err
+		}
+
+		addr, err := w.Resolve(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve advertised address: %s", err)
+		}
+
+		log.Infof("resolved advertised address %s", addr)
+		cfg.DNS.Address = addr
+		u.addresses = w
+	}
+
+	u.dns, err = dns.NewRegistrar(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Updater{
-		cfg:    cfg,
-		dns:    reg,
-		render: r,
-		cache:  make(map[string]*types.LoadBalancerUpstreamDefinition),
-	}, nil
+	for _, opt := range opts {
+		opt(u)
+	}
+
+	return u, nil
 }
 
 type Updater struct {
 	cfg            *configuration.Config
-	render         *Renderer
+	backend        Backend
 	dns            dns.Registrar
+	addresses      *address.Watcher
+	recorder       record.EventRecorder
 	cache          map[string]*types.LoadBalancerUpstreamDefinition
 	reloadRequired bool
+
+	// leading reports leadership changes when leader election is enabled, while standing by
+	// configuration is still rendered but DNS records are left to the leader
+	leading <-chan bool
+	standby int32
+	// pendingAddress is an advertised address not yet applied to DNS records, because this instance
+	// is standing by or applying it failed, it is retried on every tick
+	pendingAddress string
 }
 
+// OnExit removes the DNS records of every domain when leading and then stops the backend. With
+// leader election the records are kept instead, for the next leader to take over without a gap.
 func (u *Updater) OnExit() error {
-	if u.dns != nil {
+	defer u.backend.Stop()
+
+	if u.dns != nil && u.isLeader() && !u.leaderElection() {
 		return u.dns.RemoveAll()
 	}
 
 	return nil
 }
 
-func (u *Updater) Start(changes chan *types.Change) {
+func (u *Updater) leaderElection() bool {
+	if u.cfg.Kubernetes == nil || u.cfg.Kubernetes.LeaderElection == nil {
+		return false
+	}
+
+	return u.cfg.Kubernetes.LeaderElection.Enabled
+}
+
+// Start applies changes taken from the queue until stop is closed or the queue is shut down. Changes
+// still queued when stop is closed are dropped, so that nothing is applied once OnExit may run.
+func (u *Updater) Start(changes *queue.Queue, stop <-chan struct{}) {
 	ticker := time.NewTicker(*u.cfg.LoadBalancer.ReconcileDuration)
 	defer ticker.Stop()
 
-	for {
-		select {
-		case change, ok := <-changes:
+	reconcileInterval := dnsReconcileInterval
+	if u.cfg.DNS.ReconcileInterval != nil {
+		reconcileInterval = *u.cfg.DNS.ReconcileInterval
+	}
+
+	reconcileTicker := time.NewTicker(reconcileInterval)
+	defer reconcileTicker.Stop()
+
+	var addresses <-chan string
+	if u.addresses != nil {
+		addresses = u.addresses.Start(stop)
+	}
+
+	// the queue blocks until a change is available, so it is drained in the background
+	// and each change handed to the loop below, which marks it done once processed
+	next := make(chan *types.Change)
+	go func() {
+		defer close(next)
+
+		for {
+			change, ok := changes.Get()
 			if !ok {
 				return
 			}
 
-			u.cache[change.Obj.Domain] = change.Obj
+			select {
+			case next <- change:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for {
+		// stopping takes precedence over changes which are ready at the same time
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		select {
+		case <-stop:
+			return
+		case addr, ok := <-addresses:
+			if !ok {
+				addresses = nil
+				continue
+			}
 
-			if !u.shouldProcessChange(change) {
-				changes <- change
+			u.setAddress(addr)
+		case isLeader, ok := <-u.leading:
+			if !ok {
+				u.leading = nil
 				continue
 			}
 
-			if err := u.handleChange(change.Obj); err != nil {
-				log.Error(err)
-				change.Retried += 1
-				if change.Retried < retryAttempts {
-					log.Infof("retry %d/%d: reschedule change for %s", change.Retried, retryAttempts, change.Obj.Domain)
-					change.RetryAfter = aws.Time(time.Now().Add(time.Second * 5))
-					changes <- change
-				} else {
-					log.Infof("retry %d/%d: change for %s could not be applied", change.Retried, retryAttempts, change.Obj.Domain)
-				}
+			u.setLeader(isLeader)
+		case change, ok := <-next:
+			if !ok {
+				return
+			}
+
+			u.processChange(changes, change)
+			changes.Done(change)
+		case <-reconcileTicker.C:
+			if !u.isLeader() {
 				continue
 			}
 
-			if err := u.dns.Add(change.Obj.Domain); err != nil {
-				log.Errorf("unable to update DNS record for %s: %s", change.Obj.Domain, err)
+			if err := u.dns.Reconcile(); err != nil {
+				log.Errorf("unable to reconcile DNS records: %s", err)
 			}
 		case <-ticker.C:
+			if u.pendingAddress != "" && u.isLeader() {
+				u.setAddress(u.pendingAddress)
+			}
+
 			if u.reloadRequired {
 				u.reloadRequired = false
 
-				if reloadErr := u.reloadProcess(); reloadErr != nil {
-					log.Error(reloadErr)
+				if reloadErr := u.backend.Reload(); reloadErr != nil {
+					u.handleReloadError(reloadErr)
+					continue
 				}
 
 				log.Debugf("process reloaded successfully")
@@ -103,68 +207,197 @@ func (u *Updater) Start(changes chan *types.Change) {
 	}
 }
 
-func (u *Updater) shouldProcessChange(change *types.Change) bool {
-	if change.RetryAfter != nil {
-		if time.Now().Before(*change.RetryAfter) {
-			return false
+// RemoveStale removes the configuration of domains left behind by a previous run which are not in
+// current, the domains claimed once the watcher's caches have synced, reloading once if needed.
+func (u *Updater) RemoveStale(current types.Set[string]) error {
+	reload, err := u.backend.RemoveStale(current)
+	if reload {
+		if reloadErr := u.backend.Reload(); reloadErr != nil {
+			u.handleReloadError(reloadErr)
 		}
 	}
 
-	return true
+	return err
 }
 
-func (u *Updater) handleChange(change *types.LoadBalancerUpstreamDefinition) error {
-	filename := strings.ReplaceAll(change.Domain, ".", "_") + ".cfg"
-	tmpFilePath := filepath.Join("/tmp", filename)
+// processChange renders or removes the configuration of a domain and updates its DNS record, requeueing
+// the change with a backoff when the configuration could not be written.
+func (u *Updater) processChange(changes *queue.Queue, change *types.Change) {
+	if !change.Removed && len(change.Obj.Servers) == 0 && !u.applyEmptyUpstreamPolicy(change) {
+		changes.Forget(change)
+		return
+	}
+
+	if change.Removed {
+		delete(u.cache, change.Obj.Domain)
+	} else {
+		u.cache[change.Obj.Domain] = change.Obj
+	}
 
-	if tmpErr := u.tryWriteToFile(tmpFilePath, change); tmpErr != nil {
-		return tmpErr
+	var reload bool
+	var err error
+	if change.Removed {
+		reload, err = u.backend.Remove(change.Obj.Domain)
+	} else {
+		reload, err = u.backend.Apply(change.Obj)
 	}
 
-	fullFilePath := filepath.Join(u.cfg.LoadBalancer.ConfigDir, filename)
+	if reload {
+		log.Debug("reload required")
+		u.reloadRequired = true
+	}
 
-	areEq, err := checksumsEqual(tmpFilePath, fullFilePath)
 	if err != nil {
-		return err
+		log.Error(err)
+
+		// retrying does not help until the service's annotation is corrected, which queues a new change
+		var templateErr *TemplateNotFoundError
+		if errors.As(err, &templateErr) {
+			u.recordEvent(change.Obj, corev1.EventTypeWarning, "UnknownTemplate", err.Error())
+			changes.Forget(change)
+			return
+		}
+
+		if changes.Retry(change) {
+			log.Infof("attempt %d/%d failed: reschedule change for %s", changes.Retries(change), changes.MaxAttempts(), change.Obj.Domain)
+		} else {
+			log.Infof("attempt %d/%d failed: change for %s could not be applied", changes.MaxAttempts(), changes.MaxAttempts(), change.Obj.Domain)
+		}
+		return
+	}
+
+	changes.Forget(change)
+
+	if !u.isLeader() {
+		return
+	}
+
+	if change.Removed {
+		if err := u.dns.Remove(change.Obj.Domain); err != nil {
+			u.handleDNSError(change.Obj, err)
+		}
+		return
 	}
 
-	if areEq {
-		log.Debugf("configuration for %s domain is already up to date, skipping", change.Domain)
-		return nil
+	if err := u.dns.Add(change.Obj.Domain, u.owner(change.Obj)); err != nil {
+		u.handleDNSError(change.Obj, err)
 	}
+}
 
-	log.Debugf("configuration for %s domain has changed, updating", change.Domain)
+func (u *Updater) isLeader() bool {
+	return atomic.LoadInt32(&u.standby) == 0
+}
 
-	if fErr := u.tryWriteToFile(fullFilePath, change); fErr != nil {
-		return fErr
+// setLeader switches between managing DNS records and standing by. On taking over, records are
+// registered for every domain rendered while standing by, using the latest advertised address,
+// and reconciled.
+func (u *Updater) setLeader(isLeader bool) {
+	if isLeader == u.isLeader() {
+		return
 	}
 
-	log.Debugf("successfully updated configuration file %s", fullFilePath)
-	log.Debug("reload required")
-	u.reloadRequired = true
+	if !isLeader {
+		atomic.StoreInt32(&u.standby, 1)
+		return
+	}
 
-	return nil
+	atomic.StoreInt32(&u.standby, 0)
+
+	if u.pendingAddress != "" {
+		u.setAddress(u.pendingAddress)
+	}
+
+	owners := make(map[string]dns.Owner, len(u.cache))
+	for domain, def := range u.cache {
+		owners[domain] = u.owner(def)
+	}
+
+	for domain, err := range u.dns.AddAll(owners) {
+		u.handleDNSError(u.cache[domain], err)
+	}
+
+	// Add skips domains registered during an earlier term, whose records the other leader has
+	// since overwritten, so every known record is re-asserted
+	if err := u.dns.Reconcile(); err != nil {
+		log.Errorf("unable to reconcile DNS records: %s", err)
+	}
 }
 
-func (u *Updater) tryWriteToFile(fullFilePath string, change *types.LoadBalancerUpstreamDefinition) error {
-	f, fErr := os.OpenFile(fullFilePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+// setAddress points the DNS records at addr, keeping it pending while standing by or when the
+// records could not be updated, so that it is applied on taking over or retried on the next tick.
+func (u *Updater) setAddress(addr string) {
+	u.pendingAddress = addr
 
-	if fErr != nil {
-		return fmt.Errorf("unable to open %s: %s", fullFilePath, fErr)
+	if !u.isLeader() {
+		return
 	}
 
-	if wErr := u.render.ToWriter(f, change); wErr != nil {
-		return fmt.Errorf("unable to write to file %s: %s", fullFilePath, wErr)
+	if err := u.dns.SetAddress(addr); err != nil {
+		log.Errorf("unable to update DNS records to new address %s, retrying: %s", addr, err)
+		return
 	}
 
-	return nil
+	u.pendingAddress = ""
 }
 
-func (u *Updater) reloadProcess() error {
-	cmdParts, err := shlex.Split(u.cfg.LoadBalancer.ReloadCmd)
-	if err != nil {
-		return err
+// applyEmptyUpstreamPolicy decides what happens to a change without servers, returning false when
+// the last known servers should be kept and the change dropped.
+func (u *Updater) applyEmptyUpstreamPolicy(change *types.Change) bool {
+	switch u.cfg.LoadBalancer.EmptyUpstreamPolicy {
+	case configuration.EmptyUpstreamEmpty:
+		log.Infof("%s has no ready addresses, rendering an empty backend", change.Obj.Domain)
+		return true
+	case configuration.EmptyUpstreamRemove:
+		log.Infof("%s has no ready addresses, removing it", change.Obj.Domain)
+		change.Removed = true
+		return true
+	default:
+		log.Infof("%s has no ready addresses, keeping the last known servers", change.Obj.Domain)
+		return false
+	}
+}
+
+func (u *Updater) owner(def *types.LoadBalancerUpstreamDefinition) dns.Owner {
+	o := dns.Owner{Namespace: def.Namespace, Service: def.Service}
+	if u.cfg.Kubernetes != nil {
+		o.LoadBalancerId = u.cfg.Kubernetes.ServiceAnnotationLoadBalancerId
+	}
+
+	return o
+}
+
+func (u *Updater) handleDNSError(def *types.LoadBalancerUpstreamDefinition, err error) {
+	var ownershipErr *dns.OwnershipError
+	if errors.As(err, &ownershipErr) {
+		log.Warn(err)
+		u.recordEvent(def, corev1.EventTypeWarning, "DNSOwnershipConflict", err.Error())
+		return
 	}
-	cmd := exec.Command(cmdParts[0], cmdParts[1:]...)
-	return cmd.Run()
+
+	log.Errorf("unable to update DNS record for %s: %s", def.Domain, err)
+}
+
+// handleReloadError reports configuration rejected by validate-cmd on the services of the offending domains.
+func (u *Updater) handleReloadError(err error) {
+	log.Error(err)
+
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		return
+	}
+
+	for _, domain := range validationErr.Domains {
+		if def, exists := u.cache[domain]; exists {
+			u.recordEvent(def, corev1.EventTypeWarning, "InvalidConfiguration", validationErr.Output)
+		}
+	}
+}
+
+func (u *Updater) recordEvent(def *types.LoadBalancerUpstreamDefinition, eventType, reason, message string) {
+	if u.recorder == nil || def.Service == "" {
+		return
+	}
+
+	ref := &corev1.ObjectReference{Kind: "Service", APIVersion: "v1", Namespace: def.Namespace, Name: def.Service}
+	u.recorder.Event(ref, eventType, reason, message)
 }
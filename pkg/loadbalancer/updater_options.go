@@ -0,0 +1,21 @@
+package loadbalancer
+
+import "k8s.io/client-go/tools/record"
+
+type UpdaterOptions func(*Updater)
+
+// WithEventRecorder publishes problems affecting a service, such as DNS ownership conflicts, as events on that service.
+func WithEventRecorder(r record.EventRecorder) UpdaterOptions {
+	return func(u *Updater) {
+		u.recorder = r
+	}
+}
+
+// WithLeaderElection starts the updater in standby, only managing DNS records while the last value
+// received from leading is true.
+func WithLeaderElection(leading <-chan bool) UpdaterOptions {
+	return func(u *Updater) {
+		u.leading = leading
+		u.standby = 1
+	}
+}
@@ -2,111 +2,363 @@ package loadbalancer
 
 import (
 	"balanced/pkg/configuration"
+	"balanced/pkg/dns"
+	"balanced/pkg/queue"
 	"balanced/pkg/types"
 	"errors"
-	"io/ioutil"
-	"os"
-	"strings"
 	"testing"
-	"text/template"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/tools/record"
 )
 
-type setupChangeTestHandler func(*configuration.LoadBalancer, *types.LoadBalancerUpstreamDefinition)
+func TestUpdater_handleDNSError(t *testing.T) {
+	def := &types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Namespace: "default", Service: "web"}
 
-func testRenderTemplate(text string, obj interface{}) string {
-	t := template.Must(template.New("foobar").Parse(text))
+	tests := map[string]struct {
+		err            error
+		expectedEvents []string
+	}{
+		"records warning event on ownership conflict": {
+			&dns.OwnershipError{Domain: "hi.com"},
+			[]string{"Warning DNSOwnershipConflict refusing to modify dns record for hi.com: "},
+		},
+		"does not record event for other errors": {
+			errors.New("throttled"),
+			[]string{},
+		},
+	}
+
+	for name, test := range tests {
+		recorder := record.NewFakeRecorder(10)
+		u := &Updater{cfg: &configuration.Config{}, recorder: recorder}
+
+		u.handleDNSError(def, test.err)
+		close(recorder.Events)
+
+		events := make([]string, 0)
+		for e := range recorder.Events {
+			events = append(events, e)
+		}
+
+		assert.Equal(t, test.expectedEvents, events, name)
+	}
+}
+
+func TestUpdater_applyEmptyUpstreamPolicy(t *testing.T) {
+	tests := map[string]struct {
+		policy          string
+		expectedProcess bool
+		expectedRemoved bool
+	}{
+		"keep drops the change": {
+			configuration.EmptyUpstreamKeep,
+			false,
+			false,
+		},
+		"empty processes the change as is": {
+			configuration.EmptyUpstreamEmpty,
+			true,
+			false,
+		},
+		"remove turns the change into a removal": {
+			configuration.EmptyUpstreamRemove,
+			true,
+			true,
+		},
+	}
+
+	for name, test := range tests {
+		u := &Updater{cfg: &configuration.Config{LoadBalancer: &configuration.LoadBalancer{EmptyUpstreamPolicy: test.policy}}}
+		change := &types.Change{Obj: &types.LoadBalancerUpstreamDefinition{Domain: "hi.com"}}
+
+		process := u.applyEmptyUpstreamPolicy(change)
+
+		assert.Equal(t, test.expectedProcess, process, name)
+		assert.Equal(t, test.expectedRemoved, change.Removed, name)
+	}
+}
+
+type mockRegistrar struct {
+	added      []string
+	address    string
+	addressErr error
+	reconciled bool
+	removedAll bool
+}
 
-	b := new(strings.Builder)
+func (m *mockRegistrar) Add(domain string, _ dns.Owner) error {
+	m.added = append(m.added, domain)
+	return nil
+}
 
-	if err := t.Execute(b, obj); err != nil {
-		return err.Error()
+func (m *mockRegistrar) AddAll(owners map[string]dns.Owner) map[string]error {
+	for domain := range owners {
+		m.added = append(m.added, domain)
 	}
+	return nil
+}
+
+func (m *mockRegistrar) Remove(string) error { return nil }
 
-	return b.String()
+func (m *mockRegistrar) RemoveAll() error {
+	m.removedAll = true
+	return nil
 }
 
-func testReadFile(fp string) string {
-	data, err := ioutil.ReadFile(fp)
-	if err != nil {
-		return err.Error()
+func (m *mockRegistrar) SetAddress(addr string) error {
+	if m.addressErr != nil {
+		return m.addressErr
 	}
 
-	return string(data)
+	m.address = addr
+	return nil
 }
 
-func TestUpdater_handleChange(t *testing.T) {
-	templateText := `backend {{.Domain}}
-  balance roundrobin
-  {{range .Servers -}}
-  server {{.Id}} {{.IPAddress}}:{{.Port}} check check-ssl
-  {{end}}`
+func (m *mockRegistrar) Reconcile() error {
+	m.reconciled = true
+	return nil
+}
 
-	servers := []*types.Server{
-		{Id: "one", IPAddress: "10.1.1.1", Port: 80},
-		{Id: "two", IPAddress: "10.1.1.2", Port: 80},
-		{Id: "three", IPAddress: "10.1.1.3", Port: 80},
+func TestUpdater_setLeader(t *testing.T) {
+	tests := map[string]struct {
+		standby           int32
+		isLeader          bool
+		expectedAdded     []string
+		expectedAddress   string
+		expectedReconcile bool
+	}{
+		"registers every rendered domain on taking over": {
+			1,
+			true,
+			[]string{"hi.com"},
+			"10.0.0.2",
+			true,
+		},
+		"does nothing when already leading": {
+			0,
+			true,
+			nil,
+			"",
+			false,
+		},
+		"stands by without touching records": {
+			0,
+			false,
+			nil,
+			"",
+			false,
+		},
+	}
+
+	for name, test := range tests {
+		registrar := &mockRegistrar{}
+		u := &Updater{
+			cfg:            &configuration.Config{},
+			dns:            registrar,
+			cache:          map[string]*types.LoadBalancerUpstreamDefinition{"hi.com": {Domain: "hi.com"}},
+			standby:        test.standby,
+			pendingAddress: "10.0.0.2",
+		}
+
+		u.setLeader(test.isLeader)
+
+		assert.Equal(t, test.isLeader, u.isLeader(), name)
+		assert.Equal(t, test.expectedAdded, registrar.added, name)
+		assert.Equal(t, test.expectedAddress, registrar.address, name)
+		assert.Equal(t, test.expectedReconcile, registrar.reconciled, name)
 	}
+}
 
+func TestUpdater_setAddress(t *testing.T) {
 	tests := map[string]struct {
-		cfg         *configuration.LoadBalancer
-		change      *types.LoadBalancerUpstreamDefinition
-		setup       setupChangeTestHandler
-		expectedErr error
-		verify      func(string)
+		standby         int32
+		addressErr      error
+		expectedAddress string
+		expectedPending string
 	}{
-		"returns error when file path does not exist": {
-			&configuration.LoadBalancer{Template: templateText, ReloadCmd: "ls -al", ConfigDir: "/foob"},
-			&types.LoadBalancerUpstreamDefinition{Domain: "hi.com"},
-			func(*configuration.LoadBalancer, *types.LoadBalancerUpstreamDefinition) {},
-			errors.New("unable to open /foob/hi_com.cfg: open /foob/hi_com.cfg: no such file or directory"),
-			func(string) {},
-		},
-		"creates file if it does not exist and populates": {
-			&configuration.LoadBalancer{Template: templateText, ReloadCmd: "ls -al", ConfigDir: "/tmp"},
-			&types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Servers: servers},
-			func(*configuration.LoadBalancer, *types.LoadBalancerUpstreamDefinition) {},
+		"applies the address when leading": {
+			0,
 			nil,
-			func(name string) {
-				fp := "/tmp/hi_com.cfg"
-				defer os.Remove(fp)
-
-				assert.Equal(t, testRenderTemplate(templateText, &types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Servers: servers}), testReadFile(fp), name)
-			},
-		},
-		"updates existing file": {
-			&configuration.LoadBalancer{Template: templateText, ReloadCmd: "ls -al", ConfigDir: "/tmp"},
-			&types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Servers: servers[2:]},
-			func(lb *configuration.LoadBalancer, def *types.LoadBalancerUpstreamDefinition) {
-				f, err := os.Create(lb.ConfigDir + "/hi_com.cfg")
-				if err != nil {
-					t.Fatal(err)
-				}
-
-				f.WriteString(testRenderTemplate(templateText, def))
-			},
+			"10.0.0.2",
+			"",
+		},
+		"keeps the address pending when it could not be applied": {
+			0,
+			errors.New("throttled"),
+			"",
+			"10.0.0.2",
+		},
+		"keeps the address pending while standing by": {
+			1,
 			nil,
-			func(name string) {
-				fp := "/tmp/hi_com.cfg"
-				defer os.Remove(fp)
+			"",
+			"10.0.0.2",
+		},
+	}
+
+	for name, test := range tests {
+		registrar := &mockRegistrar{addressErr: test.addressErr}
+		u := &Updater{cfg: &configuration.Config{}, dns: registrar, standby: test.standby}
+
+		u.setAddress("10.0.0.2")
+
+		assert.Equal(t, test.expectedAddress, registrar.address, name)
+		assert.Equal(t, test.expectedPending, u.pendingAddress, name)
+	}
+}
 
-				assert.Equal(t, testRenderTemplate(templateText, &types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Servers: servers[2:]}), testReadFile(fp), name)
-			},
+func TestUpdater_OnExit(t *testing.T) {
+	tests := map[string]struct {
+		kubernetes         *configuration.KubeConfig
+		expectedRemovedAll bool
+	}{
+		"removes every record": {
+			nil,
+			true,
+		},
+		"keeps records for the next leader with leader election": {
+			&configuration.KubeConfig{LeaderElection: &configuration.LeaderElection{Enabled: true}},
+			false,
 		},
 	}
 
 	for name, test := range tests {
-		test.setup(test.cfg, test.change)
+		backend := &mockBackend{}
+		registrar := &mockRegistrar{}
+		u := &Updater{cfg: &configuration.Config{Kubernetes: test.kubernetes}, backend: backend, dns: registrar}
+
+		assert.NoError(t, u.OnExit(), name)
+		assert.True(t, backend.stopped, name)
+		assert.Equal(t, test.expectedRemovedAll, registrar.removedAll, name)
+	}
+}
+
+func TestUpdater_StartStopsWithoutDraining(t *testing.T) {
+	interval := time.Minute
+	backend := &mockBackend{}
+	u := &Updater{
+		cfg:     &configuration.Config{LoadBalancer: &configuration.LoadBalancer{ReconcileDuration: &interval}},
+		backend: backend,
+		dns:     &mockRegistrar{},
+		cache:   make(map[string]*types.LoadBalancerUpstreamDefinition),
+	}
+
+	changes := queue.New(3)
+	changes.Add(&types.Change{Obj: &types.LoadBalancerUpstreamDefinition{Domain: "hi.com"}})
+
+	stop := make(chan struct{})
+	close(stop)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		u.Start(changes, stop)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Start did not return once stopped")
+	}
+
+	assert.Empty(t, backend.applied)
+	changes.ShutDown()
+}
+
+type mockBackend struct {
+	reload  bool
+	err     error
+	applied []string
+	removed []string
+	stopped bool
+}
 
+func (m *mockBackend) Apply(def *types.LoadBalancerUpstreamDefinition) (bool, error) {
+	m.applied = append(m.applied, def.Domain)
+	return m.reload, m.err
+}
+
+func (m *mockBackend) Remove(domain string) (bool, error) {
+	m.removed = append(m.removed, domain)
+	return m.reload, m.err
+}
+
+func (m *mockBackend) Reload() error { return nil }
+
+func (m *mockBackend) RemoveStale(types.Set[string]) (bool, error) { return m.reload, m.err }
+
+func (m *mockBackend) Validate() error { return nil }
+
+func (m *mockBackend) Stop() { m.stopped = true }
+
+func TestUpdater_processChange(t *testing.T) {
+	servers := []*types.Server{{Id: "one", IPAddress: "10.1.1.1", Port: 80}}
+
+	tests := map[string]struct {
+		backend         *mockBackend
+		change          *types.Change
+		expectedApplied []string
+		expectedRemoved []string
+		expectedReload  bool
+		expectedAdded   []string
+		expectedRetries int
+	}{
+		"applies change and registers domain": {
+			&mockBackend{reload: true},
+			&types.Change{Obj: &types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Servers: servers}},
+			[]string{"hi.com"},
+			nil,
+			true,
+			[]string{"hi.com"},
+			0,
+		},
+		"removes domain": {
+			&mockBackend{},
+			&types.Change{Obj: &types.LoadBalancerUpstreamDefinition{Domain: "hi.com"}, Removed: true},
+			nil,
+			[]string{"hi.com"},
+			false,
+			nil,
+			0,
+		},
+		"retries change the backend could not apply": {
+			&mockBackend{err: errors.New("disk full")},
+			&types.Change{Obj: &types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Servers: servers}},
+			[]string{"hi.com"},
+			nil,
+			false,
+			nil,
+			1,
+		},
+		"does not retry change naming an unknown template": {
+			&mockBackend{err: &TemplateNotFoundError{Name: "tcp"}},
+			&types.Change{Obj: &types.LoadBalancerUpstreamDefinition{Domain: "hi.com", Servers: servers, Template: "tcp"}},
+			[]string{"hi.com"},
+			nil,
+			false,
+			nil,
+			0,
+		},
+	}
+
+	for name, test := range tests {
+		registrar := &mockRegistrar{}
 		u := &Updater{
-			cfg:    &configuration.Config{LoadBalancer: test.cfg},
-			render: &Renderer{t: template.Must(template.New("foo").Parse(templateText))},
+			cfg:     &configuration.Config{LoadBalancer: &configuration.LoadBalancer{}},
+			backend: test.backend,
+			dns:     registrar,
+			cache:   make(map[string]*types.LoadBalancerUpstreamDefinition),
 		}
 
-		err := u.handleChange(test.change)
+		changes := queue.New(3)
+		u.processChange(changes, test.change)
 
-		assert.Equal(t, test.expectedErr, err, name)
-		test.verify(name)
+		assert.Equal(t, test.expectedApplied, test.backend.applied, name)
+		assert.Equal(t, test.expectedRemoved, test.backend.removed, name)
+		assert.Equal(t, test.expectedReload, u.reloadRequired, name)
+		assert.Equal(t, test.expectedAdded, registrar.added, name)
+		assert.Equal(t, test.expectedRetries, changes.Retries(test.change), name)
 	}
 }
@@ -0,0 +1,114 @@
+package queue
+
+import (
+	"balanced/pkg/types"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	retryBaseDelay = time.Second * 5
+	retryMaxDelay  = time.Minute * 5
+)
+
+// Queue hands changes from the watcher to the updater keyed by domain, so several changes to a domain
+// made before the updater gets to it collapse into the latest one.
+type Queue struct {
+	queue       workqueue.RateLimitingInterface
+	maxAttempts int
+	pending     map[string]*types.Change
+	mx          *sync.Mutex
+}
+
+// Add queues change, replacing any change for the same domain which has not been processed yet.
+func (q *Queue) Add(change *types.Change) {
+	q.mx.Lock()
+	q.pending[change.Obj.Domain] = change
+	q.mx.Unlock()
+
+	q.queue.Add(change.Obj.Domain)
+}
+
+// Get blocks until a change is available, returning false once the queue has been shut down.
+// Done must be called once the change has been processed.
+func (q *Queue) Get() (*types.Change, bool) {
+	for {
+		key, shutdown := q.queue.Get()
+		if shutdown {
+			return nil, false
+		}
+
+		domain := key.(string)
+
+		q.mx.Lock()
+		change, exists := q.pending[domain]
+		delete(q.pending, domain)
+		q.mx.Unlock()
+
+		if exists {
+			return change, true
+		}
+
+		q.queue.Done(key)
+	}
+}
+
+// Done marks the change as processed, allowing the domain to be handed out again.
+func (q *Queue) Done(change *types.Change) {
+	q.queue.Done(change.Obj.Domain)
+}
+
+// Forget clears the retry history of the change's domain after it was applied successfully.
+func (q *Queue) Forget(change *types.Change) {
+	q.queue.Forget(change.Obj.Domain)
+}
+
+// Retry requeues a change which could not be applied with an exponential backoff, returning false once
+// the change has been attempted maxAttempts times. A newer change for the same domain takes precedence over the retry.
+func (q *Queue) Retry(change *types.Change) bool {
+	if q.Retries(change) >= q.maxAttempts-1 {
+		q.queue.Forget(change.Obj.Domain)
+		return false
+	}
+
+	q.mx.Lock()
+	if _, exists := q.pending[change.Obj.Domain]; !exists {
+		q.pending[change.Obj.Domain] = change
+	}
+	q.mx.Unlock()
+
+	q.queue.AddRateLimited(change.Obj.Domain)
+
+	return true
+}
+
+// Retries returns how many times the change's domain has been retried since it was last applied.
+func (q *Queue) Retries(change *types.Change) int {
+	return q.queue.NumRequeues(change.Obj.Domain)
+}
+
+// MaxAttempts returns how many times a change is attempted before it is dropped, including the first attempt.
+func (q *Queue) MaxAttempts() int {
+	return q.maxAttempts
+}
+
+// Len returns the number of domains waiting to be processed.
+func (q *Queue) Len() int {
+	return q.queue.Len()
+}
+
+// ShutDown stops handing out changes, Get returns false once the queue has drained.
+func (q *Queue) ShutDown() {
+	q.queue.ShutDown()
+}
+
+func New(maxAttempts int) *Queue {
+	return &Queue{
+		queue:       workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(retryBaseDelay, retryMaxDelay)),
+		maxAttempts: maxAttempts,
+		pending:     make(map[string]*types.Change),
+		mx:          &sync.Mutex{},
+	}
+}
@@ -0,0 +1,116 @@
+package queue
+
+import (
+	"balanced/pkg/types"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testChange(domain string, servers int) *types.Change {
+	def := &types.LoadBalancerUpstreamDefinition{Domain: domain, Servers: make([]*types.Server, 0)}
+	for i := 0; i < servers; i++ {
+		def.Servers = append(def.Servers, &types.Server{})
+	}
+
+	return &types.Change{Obj: def}
+}
+
+func TestQueue_AddCollapsesChangesPerDomain(t *testing.T) {
+	q := New(3)
+
+	q.Add(testChange("foo.com", 1))
+	q.Add(testChange("bar.com", 1))
+	q.Add(testChange("foo.com", 2))
+	q.Add(testChange("foo.com", 3))
+
+	assert.Equal(t, 2, q.Len())
+
+	change, ok := q.Get()
+	assert.True(t, ok)
+	assert.Equal(t, "foo.com", change.Obj.Domain)
+	assert.Len(t, change.Obj.Servers, 3)
+	q.Done(change)
+
+	change, ok = q.Get()
+	assert.True(t, ok)
+	assert.Equal(t, "bar.com", change.Obj.Domain)
+	q.Done(change)
+
+	assert.Equal(t, 0, q.Len())
+}
+
+func TestQueue_AddWhileProcessingRequeuesDomain(t *testing.T) {
+	q := New(3)
+
+	q.Add(testChange("foo.com", 1))
+	change, _ := q.Get()
+
+	q.Add(testChange("foo.com", 2))
+	assert.Equal(t, 0, q.Len(), "domain must not be handed out while it is being processed")
+
+	q.Done(change)
+
+	change, ok := q.Get()
+	assert.True(t, ok)
+	assert.Len(t, change.Obj.Servers, 2)
+}
+
+func TestQueue_Retry(t *testing.T) {
+	q := New(3)
+	change := testChange("foo.com", 1)
+
+	assert.True(t, q.Retry(change))
+	assert.Equal(t, 1, q.Retries(change))
+	assert.True(t, q.Retry(change))
+	assert.Equal(t, 2, q.Retries(change))
+	assert.False(t, q.Retry(change))
+	assert.Equal(t, 0, q.Retries(change))
+}
+
+func TestQueue_RetryAttempts(t *testing.T) {
+	tests := map[string]struct {
+		maxAttempts      int
+		expectedAttempts int
+	}{
+		"attempts change once without retries": {1, 1},
+		"attempts change retry-attempts times": {3, 3},
+	}
+
+	for name, test := range tests {
+		q := New(test.maxAttempts)
+		change := testChange("foo.com", 1)
+
+		// every failed attempt is followed by a call to Retry, the change is attempted again while it returns true
+		attempts := 1
+		for q.Retry(change) {
+			attempts++
+		}
+
+		assert.Equal(t, test.expectedAttempts, attempts, name)
+	}
+}
+
+func TestQueue_RetryKeepsNewerChange(t *testing.T) {
+	q := New(3)
+
+	q.Add(testChange("foo.com", 1))
+	failed, _ := q.Get()
+
+	q.Add(testChange("foo.com", 2))
+	assert.True(t, q.Retry(failed))
+	q.Done(failed)
+
+	change, ok := q.Get()
+	assert.True(t, ok)
+	assert.Len(t, change.Obj.Servers, 2)
+}
+
+func TestQueue_ShutDown(t *testing.T) {
+	q := New(3)
+	q.ShutDown()
+
+	change, ok := q.Get()
+	assert.False(t, ok)
+	assert.Nil(t, change)
+}
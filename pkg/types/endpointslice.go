@@ -0,0 +1,137 @@
+package types
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+
+	discoveryv1 "k8s.io/api/discovery/v1"
+)
+
+type sliceEndpoint struct {
+	ip       net.IP
+	port     int32
+	endpoint discoveryv1.Endpoint
+}
+
+// NewLoadBalancerDefinitionChangeFromSlices merges the EndpointSlices of a service into a single definition.
+func NewLoadBalancerDefinitionChangeFromSlices(domain, healthCheck, namespace, service string, slices []*discoveryv1.EndpointSlice) *Change {
+	def := &LoadBalancerUpstreamDefinition{
+		Domain:      domain,
+		HealthCheck: healthCheck,
+		Namespace:   namespace,
+		Service:     service,
+		Servers:     make([]*Server, 0),
+	}
+
+	for _, ep := range selectSliceEndpoints(slices) {
+		srv := &Server{
+			Id:        ep.ip.String(),
+			IPAddress: ep.ip.String(),
+			Port:      ep.port,
+			Meta:      &ServerMeta{},
+		}
+
+		if ep.endpoint.TargetRef != nil {
+			srv.Id = ep.endpoint.TargetRef.Name
+			srv.TargetRef = ep.endpoint.TargetRef.DeepCopy()
+		}
+		if ep.endpoint.Hostname != nil {
+			srv.Meta.Hostname = *ep.endpoint.Hostname
+		}
+		if ep.endpoint.NodeName != nil {
+			srv.Meta.NodeName = *ep.endpoint.NodeName
+		}
+		if ep.endpoint.Zone != nil {
+			srv.Meta.Zone = *ep.endpoint.Zone
+		}
+
+		def.Servers = append(def.Servers, srv)
+	}
+
+	return &Change{Obj: def}
+}
+
+// SortedIPsFromEndpointSlices returns the addresses selected across all slices of a service.
+func SortedIPsFromEndpointSlices(slices []*discoveryv1.EndpointSlice) []net.IP {
+	addresses := make([]net.IP, 0)
+	for _, ep := range selectSliceEndpoints(slices) {
+		addresses = append(addresses, ep.ip)
+	}
+
+	return addresses
+}
+
+// selectSliceEndpoints returns the ready endpoints across all slices, ordered by address and without
+// duplicates. When none are ready, endpoints which are terminating but still serving are returned instead
+// so existing connections can drain rather than fail.
+func selectSliceEndpoints(slices []*discoveryv1.EndpointSlice) []sliceEndpoint {
+	ready := make(map[string]sliceEndpoint)
+	draining := make(map[string]sliceEndpoint)
+
+	for _, slice := range slices {
+		if slice == nil || slice.AddressType == discoveryv1.AddressTypeFQDN || len(slice.Ports) == 0 || slice.Ports[0].Port == nil {
+			continue
+		}
+
+		port := *slice.Ports[0].Port
+
+		for _, ep := range slice.Endpoints {
+			if len(ep.Addresses) == 0 {
+				continue
+			}
+
+			ip := net.ParseIP(ep.Addresses[0])
+			if ip == nil {
+				continue
+			}
+
+			key := fmt.Sprintf("%s:%d", ip, port)
+			se := sliceEndpoint{ip: ip, port: port, endpoint: ep}
+
+			switch {
+			case isReady(ep.Conditions):
+				ready[key] = se
+			case isServing(ep.Conditions) && isTerminating(ep.Conditions):
+				draining[key] = se
+			}
+		}
+	}
+
+	selected := ready
+	if len(selected) == 0 {
+		selected = draining
+	}
+
+	endpoints := make([]sliceEndpoint, 0, len(selected))
+	for _, se := range selected {
+		endpoints = append(endpoints, se)
+	}
+
+	sort.Slice(endpoints, func(i, j int) bool {
+		if c := bytes.Compare(endpoints[i].ip, endpoints[j].ip); c != 0 {
+			return c < 0
+		}
+		return endpoints[i].port < endpoints[j].port
+	})
+
+	return endpoints
+}
+
+// isReady treats an unknown ready condition as ready, as documented for EndpointConditions.
+func isReady(c discoveryv1.EndpointConditions) bool {
+	return c.Ready == nil || *c.Ready
+}
+
+func isServing(c discoveryv1.EndpointConditions) bool {
+	if c.Serving == nil {
+		return isReady(c)
+	}
+
+	return *c.Serving
+}
+
+func isTerminating(c discoveryv1.EndpointConditions) bool {
+	return c.Terminating != nil && *c.Terminating
+}
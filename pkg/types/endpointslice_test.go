@@ -0,0 +1,84 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testEndpointSlice(name string, port int32, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta:  metav1.ObjectMeta{Name: name, Namespace: "my-ns"},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints:   endpoints,
+		Ports:       []discoveryv1.EndpointPort{{Port: aws.Int32(port)}},
+	}
+}
+
+func testSliceEndpoint(ip string, ready, serving, terminating bool) discoveryv1.Endpoint {
+	return discoveryv1.Endpoint{
+		Addresses:  []string{ip},
+		Conditions: discoveryv1.EndpointConditions{Ready: &ready, Serving: &serving, Terminating: &terminating},
+		TargetRef:  &corev1.ObjectReference{Name: "pod-" + ip},
+		NodeName:   aws.String("node-1"),
+		Zone:       aws.String("eu-west-1a"),
+	}
+}
+
+func TestNewLoadBalancerDefinitionChangeFromSlices(t *testing.T) {
+	tests := map[string]struct {
+		slices          []*discoveryv1.EndpointSlice
+		expectedServers []*Server
+	}{
+		"merges ready endpoints across slices in address order": {
+			[]*discoveryv1.EndpointSlice{
+				testEndpointSlice("a", 8443, testSliceEndpoint("10.1.1.2", true, true, false)),
+				testEndpointSlice("b", 8443, testSliceEndpoint("10.1.1.1", true, true, false), testSliceEndpoint("10.1.1.3", false, false, false)),
+			},
+			[]*Server{
+				{Id: "pod-10.1.1.1", IPAddress: "10.1.1.1", Port: 8443, Meta: &ServerMeta{NodeName: "node-1", Zone: "eu-west-1a"}, TargetRef: &corev1.ObjectReference{Name: "pod-10.1.1.1"}},
+				{Id: "pod-10.1.1.2", IPAddress: "10.1.1.2", Port: 8443, Meta: &ServerMeta{NodeName: "node-1", Zone: "eu-west-1a"}, TargetRef: &corev1.ObjectReference{Name: "pod-10.1.1.2"}},
+			},
+		},
+		"removes endpoints duplicated across slices": {
+			[]*discoveryv1.EndpointSlice{
+				testEndpointSlice("a", 8443, testSliceEndpoint("10.1.1.1", true, true, false)),
+				testEndpointSlice("b", 8443, testSliceEndpoint("10.1.1.1", true, true, false)),
+			},
+			[]*Server{
+				{Id: "pod-10.1.1.1", IPAddress: "10.1.1.1", Port: 8443, Meta: &ServerMeta{NodeName: "node-1", Zone: "eu-west-1a"}, TargetRef: &corev1.ObjectReference{Name: "pod-10.1.1.1"}},
+			},
+		},
+		"falls back to serving terminating endpoints when none are ready": {
+			[]*discoveryv1.EndpointSlice{
+				testEndpointSlice("a", 8443, testSliceEndpoint("10.1.1.1", false, true, true), testSliceEndpoint("10.1.1.2", false, false, true)),
+			},
+			[]*Server{
+				{Id: "pod-10.1.1.1", IPAddress: "10.1.1.1", Port: 8443, Meta: &ServerMeta{NodeName: "node-1", Zone: "eu-west-1a"}, TargetRef: &corev1.ObjectReference{Name: "pod-10.1.1.1"}},
+			},
+		},
+		"ignores terminating endpoints while others are ready": {
+			[]*discoveryv1.EndpointSlice{
+				testEndpointSlice("a", 8443, testSliceEndpoint("10.1.1.1", false, true, true), testSliceEndpoint("10.1.1.2", true, true, false)),
+			},
+			[]*Server{
+				{Id: "pod-10.1.1.2", IPAddress: "10.1.1.2", Port: 8443, Meta: &ServerMeta{NodeName: "node-1", Zone: "eu-west-1a"}, TargetRef: &corev1.ObjectReference{Name: "pod-10.1.1.2"}},
+			},
+		},
+		"returns no servers when there are no slices": {
+			nil,
+			[]*Server{},
+		},
+	}
+
+	for name, test := range tests {
+		change := NewLoadBalancerDefinitionChangeFromSlices("foo.com", "/health", "my-ns", "my-svc", test.slices)
+
+		assert.Equal(t, "my-svc", change.Obj.Service, name)
+		assert.Equal(t, test.expectedServers, change.Obj.Servers, name)
+	}
+}
@@ -4,21 +4,28 @@ import (
 	"bytes"
 	"net"
 	"sort"
-	"time"
 
 	corev1 "k8s.io/api/core/v1"
 )
 
 type Change struct {
-	Obj        *LoadBalancerUpstreamDefinition
-	Retried    int
-	RetryAfter *time.Time
+	Obj     *LoadBalancerUpstreamDefinition
+	Removed bool
 }
 
 type LoadBalancerUpstreamDefinition struct {
 	Domain      string
 	HealthCheck string
+	Namespace   string
+	Service     string
 	Servers     []*Server
+	// Labels of the service, and its annotations under service-annotation-key-prefix keyed without
+	// the prefix, e.g. {{.Annotations.balance}} for k8s.justcompile.io/balance
+	Labels      map[string]string
+	Annotations map[string]string
+	// Template names the template from template-dir the domain is rendered with instead of the
+	// configured one, set from the service's template annotation. Not used when aggregate is enabled.
+	Template string
 }
 
 type Server struct {
@@ -26,11 +33,17 @@ type Server struct {
 	IPAddress string
 	Port      int32
 	Meta      *ServerMeta
+	// TargetRef is the object behind the address, usually its pod, nil when the address has none
+	TargetRef *corev1.ObjectReference
+	// Weight and Backup are read from the annotations of the server's pod, Weight is nil unless annotated
+	Weight *int
+	Backup bool
 }
 
 type ServerMeta struct {
 	Hostname string
 	NodeName string
+	Zone     string
 }
 
 func NewLoadBalancerDefinitionChange(domain, healthCheck string, endpoint *corev1.Endpoints) *Change {
@@ -41,6 +54,8 @@ func NewLoadBalancerDefinitionChange(domain, healthCheck string, endpoint *corev
 	def := &LoadBalancerUpstreamDefinition{
 		Domain:      domain,
 		HealthCheck: healthCheck,
+		Namespace:   endpoint.Namespace,
+		Service:     endpoint.Name,
 		Servers:     make([]*Server, 0),
 	}
 
@@ -56,6 +71,7 @@ func NewLoadBalancerDefinitionChange(domain, healthCheck string, endpoint *corev
 					Hostname: a.Hostname,
 					NodeName: *a.NodeName,
 				},
+				TargetRef: a.TargetRef.DeepCopy(),
 			})
 		}
 	}
@@ -63,6 +79,20 @@ func NewLoadBalancerDefinitionChange(domain, healthCheck string, endpoint *corev
 	return &Change{Obj: def}
 }
 
+// NewLoadBalancerDefinitionRemoval returns a change removing the configuration and DNS record of a
+// domain which is no longer claimed by the given service.
+func NewLoadBalancerDefinitionRemoval(domain, namespace, service string) *Change {
+	return &Change{
+		Obj: &LoadBalancerUpstreamDefinition{
+			Domain:    domain,
+			Namespace: namespace,
+			Service:   service,
+			Servers:   make([]*Server, 0),
+		},
+		Removed: true,
+	}
+}
+
 func SortedIPsFromEndpoint(e *corev1.Endpoints) []net.IP {
 	if e == nil {
 		return nil
@@ -7,6 +7,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/stretchr/testify/assert"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func TestLoadBalancerUpstreamDefinitionFromK8sEndpoint(t *testing.T) {
@@ -22,6 +23,7 @@ func TestLoadBalancerUpstreamDefinitionFromK8sEndpoint(t *testing.T) {
 		},
 		"returns definition for endpoint": {
 			&corev1.Endpoints{
+				ObjectMeta: metav1.ObjectMeta{Name: "my-svc", Namespace: "my-ns"},
 				Subsets: []corev1.EndpointSubset{
 					{
 						Addresses: []corev1.EndpointAddress{
@@ -35,8 +37,10 @@ func TestLoadBalancerUpstreamDefinitionFromK8sEndpoint(t *testing.T) {
 				Obj: &LoadBalancerUpstreamDefinition{
 					Domain:      domain,
 					HealthCheck: healthCheck,
+					Namespace:   "my-ns",
+					Service:     "my-svc",
 					Servers: []*Server{
-						{Id: "my-pod-1", IPAddress: "10.1.1.1", Port: 8443, Meta: &ServerMeta{NodeName: "node-1"}},
+						{Id: "my-pod-1", IPAddress: "10.1.1.1", Port: 8443, Meta: &ServerMeta{NodeName: "node-1"}, TargetRef: &corev1.ObjectReference{Name: "my-pod-1"}},
 					},
 				},
 			},